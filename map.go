@@ -0,0 +1,67 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "unsafe"
+
+// Map is a hash map from uint64 keys to values of type V. It is a thin wrapper
+// around robinHoodMap which boxes each value so that callers never handle an
+// unsafe.Pointer.
+type Map[V any] struct {
+	m *robinHoodMap
+}
+
+// NewMap returns an empty map sized to hold initialCapacity entries without
+// growing.
+func NewMap[V any](initialCapacity int) *Map[V] {
+	return &Map[V]{m: newRobinHoodMap(initialCapacity)}
+}
+
+// Get returns the value for the specified key and whether the key was
+// present.
+func (m *Map[V]) Get(k uint64) (V, bool) {
+	p := m.m.Get(k)
+	if p == nil {
+		var zero V
+		return zero, false
+	}
+	return *(*V)(p), true
+}
+
+// Put sets the value for the specified key.
+func (m *Map[V]) Put(k uint64, v V) {
+	p := new(V)
+	*p = v
+	m.m.Put(k, unsafe.Pointer(p))
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *Map[V]) Delete(k uint64) {
+	m.m.Delete(k)
+}
+
+// Len returns the number of entries in the map.
+func (m *Map[V]) Len() int {
+	return m.m.Len()
+}
+
+// Range calls f for each entry in the map. The order of iteration is
+// unspecified. If f returns false, iteration stops.
+func (m *Map[V]) Range(f func(key uint64, value V) bool) {
+	m.m.Range(func(key uint64, value unsafe.Pointer) bool {
+		return f(key, *(*V)(value))
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testMapRoundTrip[V any](t *testing.T, values map[uint64]V) {
+	t.Helper()
+	m := NewMap[V](0)
+	for k, v := range values {
+		m.Put(k, v)
+	}
+	if m.Len() != len(values) {
+		t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+	}
+	for k, v := range values {
+		if p, ok := m.Get(k); !ok || !reflect.DeepEqual(p, v) {
+			t.Fatalf("%d: expected (%v,true), but found (%v,%t)", k, v, p, ok)
+		}
+	}
+
+	seen := make(map[uint64]V)
+	m.Range(func(k uint64, v V) bool {
+		seen[k] = v
+		return true
+	})
+	if !reflect.DeepEqual(seen, values) {
+		t.Fatalf("expected %v, but found %v", values, seen)
+	}
+
+	for k := range values {
+		m.Delete(k)
+		if p, ok := m.Get(k); ok {
+			t.Fatalf("%d: expected deleted, but found %v", k, p)
+		}
+	}
+	if m.Len() != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+}
+
+func TestMap(t *testing.T) {
+	type point struct {
+		x, y int
+	}
+	x := 7
+
+	t.Run("int", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64]int{1: 0, 2: -1, 3: 1 << 40})
+	})
+	t.Run("string", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64]string{1: "", 2: "hello", 3: "world"})
+	})
+	t.Run("struct", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64]point{1: {}, 2: {1, 2}, 3: {-3, 4}})
+	})
+	t.Run("slice", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64][]byte{1: nil, 2: {}, 3: []byte("abc")})
+	})
+	t.Run("pointer", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64]*int{1: nil, 2: &x})
+	})
+	t.Run("interface", func(t *testing.T) {
+		testMapRoundTrip(t, map[uint64]interface{}{1: nil, 2: 3, 3: "four", 4: point{5, 6}})
+	})
+}
+
+func TestMapOverwrite(t *testing.T) {
+	m := NewMap[string](0)
+	m.Put(1, "a")
+	m.Put(1, "b")
+	if v, ok := m.Get(1); !ok || v != "b" {
+		t.Fatalf("expected (b,true), but found (%s,%t)", v, ok)
+	}
+	if m.Len() != 1 {
+		t.Fatalf("expected 1 entry, but found %d", m.Len())
+	}
+	if v, ok := m.Get(2); ok || v != "" {
+		t.Fatalf("expected (,false), but found (%s,%t)", v, ok)
+	}
+}
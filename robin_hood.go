@@ -17,17 +17,48 @@ package maptoy
 
 import (
 	"fmt"
+	"math"
 	"math/bits"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"unsafe"
 )
 
 // Fibonacci hash: https://probablydance.com/2018/06/16/fibonacci-hashing-the-optimization-that-the-world-forgot-or-a-better-alternative-to-integer-modulo/
+//
+// hash returns the high 64-shift bits of the product, which is a slot in a
+// table of size 2^(64-shift). Tables range from size 1 to maxSize, so the
+// valid shifts are [64-log2(maxSize), 64] = [33, 64]. No clamping is needed
+// at either end: Go defines a shift by 64 or more to produce 0, which is the
+// only slot of a table of size 1, and for any shift of at least 32 the result
+// fits in the uint32. Below 32 the result would be truncated, but no table is
+// that large.
 func hash(k uint64, shift uint32) uint32 {
 	k |= 1
 	return uint32((k * 11400714819323198485) >> shift)
 }
 
+// fmix64 is the MurmurHash3 64-bit finalizer. It is a bijection which mixes
+// every input bit into every output bit, so mixed keys are distributed like
+// random keys whatever their structure. The Fibonacci hash alone is a single
+// multiply which maps k and k|1 to the same slot, pairing up sequential IDs,
+// and structured key sets such as sequences and strides cluster, inflating
+// probe lengths. See BenchmarkRobinHoodHashMix.
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// mixHash is the hash of the mix option: the Fibonacci hash of the mixed key.
+func mixHash(k uint64, shift uint32) uint32 {
+	return hash(fmix64(k), shift)
+}
+
 type robinHoodEntry struct {
 	key   uint64
 	value unsafe.Pointer
@@ -81,57 +112,950 @@ type robinHoodMap struct {
 	shift      uint32
 	count      uint32
 	maxDist    uint32
+	// writers counts the in-progress mutations when built with the
+	// maptoy_debug tag. See beginWrite.
+	writers int32
+	// popPos is the slot at which PopAny resumes scanning.
+	popPos uint32
+	// shared is set when the entries are shared with a snapshot. The entries
+	// are copied before the next mutation. See Snapshot.
+	shared bool
+	// frozen is set by Freeze, after which the table is never resized.
+	frozen bool
+	// minSize is the size of the table at construction, below which it is
+	// never shrunk automatically. See maybeShrink.
+	minSize uint32
+	// rehashWork counts the entries reinserted by rehashes over the lifetime
+	// of the map. See RehashWork.
+	rehashWork uint64
+	// swapCount counts the entries displaced by insertions. See SwapCount.
+	swapCount uint64
+	// generation is incremented by every mutation which moves, adds or
+	// removes entries. See Generation.
+	generation uint64
+	// cursorGeneration is the generation at which RangeFrom last returned. It
+	// is only maintained when built with the maptoy_debug tag, so that
+	// RangeFrom does not write to the map in other builds.
+	cursorGeneration uint64
+	// hasher, if non-nil, replaces hash in mapping keys to their desired
+	// slots. It is mixHash for the mix option, or the function set by Rekey.
+	hasher func(k uint64, shift uint32) uint32
+	// occupied is the occupancy bitset, or nil if it is disabled. See
+	// resetOccupancy.
+	occupied []uint64
+	// log is the operation log, or nil if it is disabled. See OpLog.
+	log  *opLog
+	opts robinHoodOptions
+}
+
+// robinHoodOptions holds the optional configuration of a robinHoodMap. The
+// zero value selects the defaults.
+type robinHoodOptions struct {
+	// growth is the factor by which the table grows when an insertion reaches
+	// maxDist. A value of 0 selects defaultGrowth.
+	growth float64
+	// maxDist returns the max distance threshold for a table of the specified
+	// size. A larger threshold allows a higher load factor at the cost of
+	// longer probes. A nil function selects maxDistForSize.
+	maxDist func(size uint32) uint32
+	// maxDistFloor replaces defaultMaxDistFloor as the smallest threshold
+	// chosen by the default max distance policy. Lowering it reduces the
+	// padding of small tables at the cost of growing them sooner. It is raised
+	// to minMaxDist if necessary, and ignored if maxDist is set. A value of 0
+	// selects defaultMaxDistFloor.
+	maxDistFloor uint32
+	// onProbe, if non-nil, is called at the end of each Get, Put and Delete
+	// with the distance probed from the desired slot of the key.
+	onProbe func(op OpKind, dist uint32)
+	// onGrow, if non-nil, is called when an insertion reaches maxDist or
+	// maxLoad and the table grows, before the entries are moved to the new
+	// table. It is not called for the initial allocation or for explicit
+	// resizing.
+	onGrow func(oldSize, newSize uint32)
+	// mix selects mixing the key with fmix64 before the Fibonacci hash. This
+	// costs a few cycles per operation in exchange for a distribution which
+	// does not depend on the structure of the keys.
+	mix bool
+	// pool selects taking entries slices from, and returning outgrown ones
+	// to, a pool shared by all maps. An Iterator must not be used across a
+	// growth of a pooled map, since its entries may be reused. See Release.
+	pool bool
+	// opLog, if positive, enables recording the most recent opLog
+	// operations for debugging: every insertion or replacement of a value as
+	// an OpPut, and every removal of a key as an OpDelete. Delete also logs
+	// an OpDelete for an absent key, with the distance probed. Clear and
+	// ClearWithCapacity are not logged. See OpLog.
+	opLog int
+	// align selects allocating the entries so that the first begins on a
+	// cache line boundary. The entries are not a multiple of the cache line
+	// size, so later entries still straddle lines, but the alignment of
+	// every entry relative to the cache lines is then the same for every
+	// table. It cannot be combined with pool. See alignedEntries.
+	align bool
+	// adaptiveMaxDist selects widening maxDist in place, rather than growing
+	// the table, when an insertion reaches maxDist while the average
+	// distance is low. See widenMaxDist.
+	adaptiveMaxDist bool
+	// shrinkBelow, if positive, enables shrinking the table automatically
+	// when a deletion leaves the load factor below it. It must be less
+	// than 1. See maybeShrink.
+	shrinkBelow float64
+	// occupancy selects maintaining a bitset of the occupied slots, which
+	// iteration scans to skip runs of empty slots. It costs a bit per slot
+	// and a little work on every insertion and deletion. See
+	// resetOccupancy.
+	occupancy bool
+	// onEvict, if non-nil, is called with the key and old value each time
+	// the map drops a value: when the entry is deleted, cleared or released,
+	// or its value is replaced by a different pointer. It is not called by
+	// LoadAndDelete, Swap and PopAny, which return the value to the caller,
+	// or for values written through the pointer returned by PutSlot. It is
+	// called in the middle of the mutation, and must not mutate the map.
+	onEvict func(key uint64, value unsafe.Pointer)
+	// maxLoad, if positive, is a load factor ceiling: an insertion which
+	// would raise count/size above it grows the table first, however short
+	// the probes are. It must be at most 1. See growForLoad.
+	maxLoad float64
+}
+
+// OpKind identifies an operation reported to a probe hook.
+type OpKind int
+
+// The operations reported to a probe hook.
+const (
+	OpGet OpKind = iota
+	OpPut
+	OpDelete
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// maxSize is the largest table size. Table sizes are powers of 2 stored in a
+// uint32, so doubling a table of this size would wrap around to 0.
+const maxSize = 1 << 31
+
+// defaultGrowth is the growth factor used when none is specified.
+const defaultGrowth = 2
+
+// grownSize returns the size to grow a table of the specified size to when
+// growing by factor. The result is rounded up to the next power of 2 in order
+// to keep the shift computation valid, which means any factor <= 2 doubles the
+// table. It panics rather than wrapping around if the table cannot grow any
+// larger.
+func grownSize(size uint32, factor float64) uint32 {
+	if size >= maxSize {
+		panic(fmt.Sprintf("robinHoodMap: cannot grow table beyond %d entries", uint32(maxSize)))
+	}
+	if factor == 0 {
+		factor = defaultGrowth
+	}
+	target := uint64(math.Ceil(float64(size) * factor))
+	if target > maxSize {
+		return maxSize
+	}
+	n := uint64(1) << uint(bits.Len64(target-1))
+	if n <= uint64(size) {
+		n = 2 * uint64(size)
+	}
+	return uint32(n)
 }
 
+// defaultMaxDistFloor is the smallest max distance threshold chosen by
+// maxDistForSize.
+const defaultMaxDistFloor = 4
+
 func maxDistForSize(size uint32) uint32 {
+	return maxDistWithFloor(size, defaultMaxDistFloor)
+}
+
+// maxDistWithFloor returns the bit length of size, which is log2(size)+1 for
+// the power of 2 table sizes, but no less than floor.
+func maxDistWithFloor(size, floor uint32) uint32 {
 	desired := uint32(bits.Len32(size))
-	if desired < 4 {
-		desired = 4
+	if desired < floor {
+		desired = floor
 	}
 	return desired
 }
 
+// scaledMaxDist returns a max distance policy which multiplies the default
+// threshold by mult and then adds slack.
+func scaledMaxDist(mult float64, slack uint32) func(size uint32) uint32 {
+	return func(size uint32) uint32 {
+		return uint32(mult*float64(maxDistForSize(size))) + slack
+	}
+}
+
+// minMaxDist is the smallest max distance threshold. A threshold of 1 would
+// grow the table on every collision, so a pair of keys with the same hash at
+// every size would grow the table without bound.
+const minMaxDist = 2
+
+func (m *robinHoodMap) maxDistForSize(size uint32) uint32 {
+	if m.opts.maxDist == nil {
+		if m.opts.maxDistFloor == 0 {
+			return maxDistForSize(size)
+		}
+		floor := m.opts.maxDistFloor
+		if floor < minMaxDist {
+			floor = minMaxDist
+		}
+		return maxDistWithFloor(size, floor)
+	}
+	d := m.opts.maxDist(size)
+	if d < minMaxDist {
+		d = minMaxDist
+	}
+	return d
+}
+
 func newRobinHoodMap(initialCapacity int) *robinHoodMap {
-	if initialCapacity < 1 {
-		initialCapacity = 1
+	return newRobinHoodMapWithOptions(initialCapacity, robinHoodOptions{})
+}
+
+// newRobinHoodMapWithGrowth returns a map which grows by the specified factor,
+// rather than doubling, when an insertion reaches the max distance. The factor
+// must be greater than 1. See grownSize for how the factor is applied.
+func newRobinHoodMapWithGrowth(initialCapacity int, factor float64) *robinHoodMap {
+	return newRobinHoodMapWithOptions(initialCapacity, robinHoodOptions{growth: factor})
+}
+
+func newRobinHoodMapWithOptions(initialCapacity int, opts robinHoodOptions) *robinHoodMap {
+	if opts.growth != 0 && !(opts.growth > 1) {
+		panic(fmt.Sprintf("robinHoodMap: growth factor must be greater than 1: %v", opts.growth))
+	}
+	if !(opts.shrinkBelow >= 0 && opts.shrinkBelow < 1) {
+		panic(fmt.Sprintf("robinHoodMap: shrink threshold must be in [0,1): %v", opts.shrinkBelow))
+	}
+	if !(opts.maxLoad >= 0 && opts.maxLoad <= 1) {
+		panic(fmt.Sprintf("robinHoodMap: load factor ceiling must be in [0,1]: %v", opts.maxLoad))
 	}
-	targetSize := 1 << uint(bits.Len(uint(2*initialCapacity-1)))
+	if opts.align && opts.pool {
+		panic("robinHoodMap: the align and pool options cannot be combined")
+	}
+	m := &robinHoodMap{opts: opts}
+	if opts.mix {
+		m.hasher = mixHash
+	}
+	if opts.opLog > 0 {
+		m.log = newOpLog(opts.opLog)
+	}
+	m.minSize = sizeForCapacity(initialCapacity)
+	m.rehash(m.minSize)
+	return m
+}
 
-	m := &robinHoodMap{}
-	m.rehash(uint32(targetSize))
+// fromGoMap returns a map holding the entries of src, sized for len(src).
+func fromGoMap(src map[uint64]unsafe.Pointer) *robinHoodMap {
+	m := newRobinHoodMap(len(src))
+	for k, v := range src {
+		m.put(k, v, true)
+	}
 	return m
 }
 
+// sizeForCapacity returns the table size used to hold the specified number of
+// entries: the smallest power of 2 which is at least twice the capacity.
+func sizeForCapacity(capacity int) uint32 {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if capacity > maxSize/2 {
+		return maxSize
+	}
+	return 1 << uint(bits.Len(uint(2*capacity-1)))
+}
+
+// Reserve grows the table, if necessary, so that it is sized to hold n
+// entries.
+func (m *robinHoodMap) Reserve(n int) {
+	if size := sizeForCapacity(n); size > m.size {
+		m.beginWrite()
+		m.rehash(size)
+		m.endWrite()
+	}
+}
+
+// ResizeTo rehashes the table to the smallest power of 2 which is at least
+// size, growing or shrinking it regardless of the load factor. The table is
+// never smaller than 2. It panics if size is smaller than the number of
+// entries or larger than the maximum table size. The table may still grow
+// further if the reinsertion reaches the max distance threshold. Resizing to
+// the current size only restores the threshold chosen for the size, which
+// rehashInPlace does within the existing storage when the entries allow it.
+func (m *robinHoodMap) ResizeTo(size int) {
+	if size < m.Len() {
+		panic(fmt.Sprintf("robinHoodMap: size %d is smaller than count %d", size, m.Len()))
+	}
+	if size > maxSize {
+		panic(fmt.Sprintf("robinHoodMap: size %d exceeds the maximum of %d", size, maxSize))
+	}
+	if size < 2 {
+		size = 2
+	}
+	target := uint32(1) << uint(bits.Len(uint(size-1)))
+	m.beginWrite()
+	if target != m.size || !m.rehashInPlace(m.maxDistForSize(target)) {
+		m.rehash(target)
+	}
+	m.endWrite()
+}
+
+// Clone returns a copy of the map with the same size, options and hash
+// function, whose entries are copied wholesale rather than reinserted. The
+// copy is independent of the map: neither sees the later mutations of the
+// other. It is not frozen even if the map is, and has an empty operation log.
+func (m *robinHoodMap) Clone() *robinHoodMap {
+	c := &robinHoodMap{opts: m.opts, hasher: m.hasher, minSize: m.minSize}
+	if m.opts.opLog > 0 {
+		c.log = newOpLog(m.opts.opLog)
+	}
+	c.size, c.shift, c.count, c.maxDist = m.size, m.shift, m.count, m.maxDist
+	c.entries = c.allocEntries(len(m.entries))
+	copy(c.entries, m.entries)
+	c.entriesPtr = unsafe.Pointer(&c.entries[0])
+	if m.occupied != nil {
+		c.occupied = append([]uint64(nil), m.occupied...)
+	}
+	return c
+}
+
+// CloneWithCapacity is like Clone, but sizes the copy for n entries, or for
+// the entries of the map if n is smaller, as newRobinHoodMap would. This
+// combines Clone with Reserve or ResizeTo in a single pass. The entries are
+// reinserted in slot order which, unless Rekey installed another hash, is
+// desired slot order at any size: the desired slot is the high bits of the
+// same product. Each insertion then lands at the end of its cluster, as in
+// rehash.
+func (m *robinHoodMap) CloneWithCapacity(n int) *robinHoodMap {
+	if n < m.Len() {
+		n = m.Len()
+	}
+	c := newRobinHoodMapWithOptions(n, m.opts)
+	c.hasher = m.hasher
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			c.put(e.key, e.value, true)
+		}
+	}
+	return c
+}
+
+// Compact shrinks the table to the smallest size, no larger than the current
+// size and large enough for the entries, at which the max distance of the
+// entries would not exceed the current max distance. This reclaims the space
+// left by deletions without lengthening probes. Robin Hood insertion
+// produces the same distances whatever the insertion order, so the layout at
+// the chosen size is already distance-minimizing and there is no benefit to
+// rehashing at the current size: if no smaller size qualifies the map is left
+// unchanged. Compact is idempotent.
+func (m *robinHoodMap) Compact() {
+	if m.count == 0 {
+		if m.size > 2 {
+			m.ResizeTo(2)
+		}
+		return
+	}
+	current := m.MaxDist()
+	m.shrinkToSmallest(func(maxDist uint32) bool { return maxDist <= current })
+}
+
+// shrinkToSmallest rehashes the table to the smallest size, smaller than the
+// current size and large enough for the entries, at which the max distance of
+// the entries would be below the threshold for that size and accepted by ok.
+// The table is left unchanged if no smaller size qualifies.
+func (m *robinHoodMap) shrinkToSmallest(ok func(maxDist uint32) bool) {
+	keys := m.Keys()
+	h := hash
+	if m.hasher != nil {
+		h = m.hasher
+	}
+	for size := sizeForCapacity(len(keys)); size < m.size; size *= 2 {
+		maxDist, _ := hashQuality(keys, size, h)
+		if maxDist < m.maxDistForSize(size) && ok(maxDist) {
+			m.beginWrite()
+			m.rehash(size)
+			m.endWrite()
+			return
+		}
+	}
+}
+
+// Clear removes every entry, keeping the current size of the table.
+func (m *robinHoodMap) Clear() {
+	m.beginWrite()
+	m.evictAll()
+	if m.shared {
+		// The snapshots keep the old entries, so start over with fresh storage
+		// rather than copying entries only to zero them.
+		m.entries = m.allocEntries(len(m.entries))
+		m.entriesPtr = unsafe.Pointer(&m.entries[0])
+		m.resetOccupancy()
+		m.shared = false
+	} else {
+		for i := range m.entries {
+			m.entries[i] = robinHoodEntry{}
+		}
+		for i := range m.occupied {
+			m.occupied[i] = 0
+		}
+	}
+	m.count = 0
+	m.popPos = 0
+	m.generation++
+	m.endWrite()
+}
+
+// ClearWithCapacity removes every entry and resizes the table to hold n
+// entries, shrinking or growing it as necessary. If the table is already the
+// right size the existing storage is reused, as in Clear.
+func (m *robinHoodMap) ClearWithCapacity(n int) {
+	size := sizeForCapacity(n)
+	if size == m.size {
+		m.Clear()
+		return
+	}
+	m.beginWrite()
+	if m.frozen {
+		m.panicFrozen()
+	}
+	m.evictAll()
+	// Dropping the entries before rehashing leaves nothing to reinsert.
+	m.entries = nil
+	m.shared = false
+	m.rehash(size)
+	m.endWrite()
+}
+
+// cacheLineSize is the assumed size of a CPU cache line.
+const cacheLineSize = 64
+
+// alignedEntries returns a zeroed entries slice of length n whose first entry
+// begins on a cache line boundary. The Go allocator only guarantees the
+// alignment of the entry type, so the slice is over-allocated by enough
+// entries to reach the next boundary and resliced.
+func alignedEntries(n int) []robinHoodEntry {
+	extra := int(cacheLineSize/unsafe.Alignof(robinHoodEntry{})) - 1
+	entries := make([]robinHoodEntry, n+extra)
+	for i := 0; i <= extra; i++ {
+		if uintptr(unsafe.Pointer(&entries[i]))%cacheLineSize == 0 {
+			return entries[i : i+n]
+		}
+	}
+	return entries[:n]
+}
+
+// prewarmSink receives the loads performed by Prewarm so that the compiler
+// cannot discard them.
+var prewarmSink uint32
+
+// Prewarm touches every cache line of the entries so that the operating
+// system maps the backing pages eagerly rather than faulting them in during
+// the first probes. The contents of the map are unchanged. A read of a page
+// which has never been written may be satisfied by a shared zero page, so
+// each line is written with an atomic add of zero, which cannot be elided.
+// If the entries are shared with a snapshot they are only read.
+func (m *robinHoodMap) Prewarm() {
+	step := uint32(cacheLineSize / unsafe.Sizeof(robinHoodEntry{}))
+	if step == 0 {
+		step = 1
+	}
+	n := uint32(len(m.entries))
+	if m.shared {
+		var sum uint32
+		for i := uint32(0); i < n; i += step {
+			sum += m.entry(i).dist
+		}
+		prewarmSink = sum
+		return
+	}
+	m.beginWrite()
+	for i := uint32(0); i < n; i += step {
+		atomic.AddUint32(&m.entry(i).dist, 0)
+	}
+	m.endWrite()
+}
+
+// BulkLoad inserts the specified key/value pairs. The table is grown once up
+// front to hold all of the entries rather than doubling repeatedly during the
+// insertions. If a key appears more than once, the last value wins.
+func (m *robinHoodMap) BulkLoad(keys []uint64, values []unsafe.Pointer) {
+	if len(keys) != len(values) {
+		panic(fmt.Sprintf("robinHoodMap: %d keys but %d values", len(keys), len(values)))
+	}
+	m.Reserve(m.Len() + len(keys))
+	m.beginWrite()
+	for i := range keys {
+		m.put(keys[i], values[i], true)
+		m.logPut(keys[i])
+	}
+	m.endWrite()
+}
+
+// PutBatch inserts the specified key/value pairs. It is the insertion
+// counterpart of DeleteBatch and behaves like BulkLoad: the table is first
+// sized for the combined count, and if a key appears more than once, the last
+// value wins. Sizing the table does not bound the probes, so an insertion
+// which reaches maxDist still grows the table during the batch.
+func (m *robinHoodMap) PutBatch(keys []uint64, values []unsafe.Pointer) {
+	m.BulkLoad(keys, values)
+}
+
+// Freeze shrinks the table to the smallest size and padding which hold its
+// entries, and fixes it there: any later operation which would resize the
+// table or its padding panics before modifying the map, and TryPut returns an
+// error instead of growing. New keys can still be inserted as long as they
+// fit. Unlike Compact, Freeze accepts longer probes in exchange for a smaller
+// table, within the threshold for the chosen size. It is intended for tables
+// which are built once, for example by BulkLoad, and afterwards only read.
+func (m *robinHoodMap) Freeze() {
+	if m.frozen {
+		return
+	}
+	m.shrinkToSmallest(func(uint32) bool { return true })
+	m.beginWrite()
+	m.rehashInPlace(m.MaxDist() + 1)
+	m.frozen = true
+	m.endWrite()
+}
+
+// rehash rebuilds the table with the specified size, reinserting every
+// entry. It always allocates a new entries slice, and the old slice remains
+// live until reinsertion completes, so memory use temporarily doubles. A
+// change of maxDist without a change of size does not require reinsertion and
+// can reuse the existing storage: see rehashInPlace.
 func (m *robinHoodMap) rehash(size uint32) {
+	if m.frozen {
+		m.panicFrozen()
+	}
 	oldEntries := m.entries
+	oldShared := m.shared
 	m.size = size
+	// For a size of 1 the shift is 64. Go defines a shift by the full width of
+	// the operand to produce 0, so hash() maps every key to slot 0 which is the
+	// only valid slot. newRobinHoodMap never creates a table smaller than 2.
 	m.shift = uint32(64 - bits.Len32(m.size-1))
-	m.maxDist = maxDistForSize(size)
-	m.entries = make([]robinHoodEntry, size+m.maxDist)
+	m.maxDist = m.maxDistForSize(size)
+	m.entries = m.allocEntries(int(size + m.maxDist))
 	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.resetOccupancy()
 	m.count = 0
+	m.popPos = 0
+	m.generation++
+	// The new entries are not shared with any snapshot.
+	m.shared = false
 
+	// Reinsert the entries in slot order. Robin Hood insertion keeps the
+	// entries sorted by desired slot, and growing the table preserves that
+	// order, so each entry lands at the end of its cluster without displacing
+	// others. Reinserting in other orders, such as by descending distance,
+	// produces the same layout but performs more swaps and measures several
+	// times slower. See BenchmarkRobinHoodRehash.
 	for i := range oldEntries {
 		e := &oldEntries[i]
 		if e.value != nil {
-			m.Put(e.key, e.value)
+			m.put(e.key, e.value, true)
+			m.rehashWork++
+		}
+	}
+	if !oldShared {
+		m.freeEntries(oldEntries)
+	}
+}
+
+// Rekey replaces the hash function which maps keys to their desired slots
+// and rebuilds the table under it, such as after rotating a hash seed. Like
+// hash, newHash must return a slot in a table of size 2^(64-shift). Every
+// entry is reinserted at the current size, which grows if newHash distributes
+// the keys worse than the old hash.
+func (m *robinHoodMap) Rekey(newHash func(k uint64, shift uint32) uint32) {
+	m.beginWrite()
+	if m.frozen {
+		// Checked before the hasher changes, which would strand the entries.
+		m.panicFrozen()
+	}
+	m.hasher = newHash
+	m.rehash(m.size)
+	m.endWrite()
+}
+
+// panicFrozen panics because an operation would resize a frozen map. The
+// callers raise it before any entry has moved, and it ends the write begun by
+// the caller, so a map whose panic is recovered is intact and still usable.
+func (m *robinHoodMap) panicFrozen() {
+	m.endWrite()
+	panic("robinHoodMap: cannot resize a frozen map")
+}
+
+// rehashInPlace changes the max distance threshold without changing the size
+// of the table. The position of every entry depends only on the size, so no
+// entries move: only the padding at the end of the table changes length.
+// Shrinking the padding reslices the existing storage, as does growing it
+// within the capacity of the entries slice. Otherwise the entries are copied
+// once into a larger slice. It returns false, leaving the map unchanged, if
+// an existing entry is too far from its desired slot for the new threshold.
+func (m *robinHoodMap) rehashInPlace(maxDist uint32) bool {
+	if m.frozen {
+		m.panicFrozen()
+	}
+	if maxDist < minMaxDist {
+		maxDist = minMaxDist
+	}
+	if maxDist <= m.MaxDist() {
+		return false
+	}
+	if m.shared {
+		m.unshare()
+	}
+	n := int(m.size + maxDist)
+	switch {
+	case n <= len(m.entries):
+		// Every entry is less than maxDist from a desired slot below size, so the
+		// truncated slots (including the new sentinel) are already empty.
+		extra := m.entries[n:]
+		for i := range extra {
+			extra[i] = robinHoodEntry{}
 		}
+		m.entries = m.entries[:n]
+	case n <= cap(m.entries):
+		// The slots between len and cap were zeroed when they were truncated, or
+		// have never been used.
+		m.entries = m.entries[:n]
+	default:
+		entries := m.allocEntries(n)
+		copy(entries, m.entries)
+		m.entries = entries
+		m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	}
+	m.resizeOccupancy(n)
+	m.maxDist = maxDist
+	m.generation++
+	return true
+}
+
+// adaptiveMaxAvgDist is the average distance above which an insertion
+// reaching maxDist grows the table even with adaptiveMaxDist.
+const adaptiveMaxAvgDist = 1.0
+
+// adaptiveMaxDistLimit bounds how far widenMaxDist may widen maxDist, as a
+// multiple of the threshold chosen for the size of the table.
+const adaptiveMaxDistLimit = 4
+
+// widenMaxDist doubles maxDist without changing the size of the table if the
+// average distance of the entries is low, returning false if it is not. A
+// low average distance means that an insertion reached maxDist because of a
+// cluster of keys with nearby desired slots, which doubling the size would
+// not disperse if the keys share the high bits of their hashes, rather than
+// because the table is full. Widening only reallocates the padding at the
+// end of the table. A rehash to a new size narrows maxDist back to the
+// threshold chosen for that size.
+func (m *robinHoodMap) widenMaxDist() bool {
+	if 2*m.maxDist > adaptiveMaxDistLimit*m.maxDistForSize(m.size) || m.AvgDist() > adaptiveMaxAvgDist {
+		return false
+	}
+	return m.rehashInPlace(2 * m.maxDist)
+}
+
+// grow grows the table because an insertion reached maxDist, or widens
+// maxDist instead if adaptiveMaxDist is set and widenMaxDist allows it.
+func (m *robinHoodMap) grow() {
+	if m.opts.adaptiveMaxDist && m.widenMaxDist() {
+		return
+	}
+	size := grownSize(m.size, m.opts.growth)
+	if m.opts.onGrow != nil {
+		m.opts.onGrow(m.size, size)
+	}
+	m.rehash(size)
+}
+
+// overLoad returns true if inserting one more entry would raise the load
+// factor above opts.maxLoad. A frozen map is never grown for load.
+func (m *robinHoodMap) overLoad() bool {
+	return m.opts.maxLoad > 0 && !m.frozen &&
+		float64(m.count+1) > m.opts.maxLoad*float64(m.size)
+}
+
+// maybeGrowForLoad grows the table if an insertion would exceed
+// opts.maxLoad, returning true if it did. Every insertion of an absent key
+// calls it once the key is known to be absent; a slot located by the probe
+// is stale after a growth, so the caller must probe again.
+func (m *robinHoodMap) maybeGrowForLoad() bool {
+	if !m.overLoad() {
+		return false
+	}
+	m.growForLoad()
+	return true
+}
+
+// growForLoad grows the table because an insertion would raise the load
+// factor above opts.maxLoad. The table grows by the growth factor as many
+// times as necessary to hold one more entry below the ceiling, so the
+// reinsertions of the rehash never trigger another growth.
+func (m *robinHoodMap) growForLoad() {
+	size := m.size
+	for float64(m.count+1) > m.opts.maxLoad*float64(size) {
+		size = grownSize(size, m.opts.growth)
+	}
+	if m.opts.onGrow != nil {
+		m.opts.onGrow(m.size, size)
+	}
+	m.rehash(size)
+}
+
+// hash returns the desired slot for the specified key. It must stay within
+// the inlining budget (see Get), which the call to hash would exceed, so the
+// Fibonacci hash is written out. Folding the mix option into hasher leaves a
+// single check on the default path.
+func (m *robinHoodMap) hash(k uint64) uint32 {
+	if m.hasher != nil {
+		return m.hasher(k, m.shift)
 	}
+	return uint32(((k | 1) * 11400714819323198485) >> m.shift)
 }
 
 func (m *robinHoodMap) entry(i uint32) *robinHoodEntry {
+	if safeChecks {
+		return &m.entries[i]
+	}
 	// Manually index into the entries array to avoid the bounds checking.
 	return (*robinHoodEntry)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntry{})))
 }
 
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry. A nil value marks an empty entry, so v must not be nil.
 func (m *robinHoodMap) Put(k uint64, v unsafe.Pointer) {
-	n := robinHoodEntry{key: k, value: v, dist: 0}
-	for i := hash(n.key, m.shift); ; i++ {
+	m.beginWrite()
+	size := m.size
+	_, dist := m.put(k, v, true)
+	if m.opts.onProbe != nil {
+		m.opts.onProbe(OpPut, dist)
+	}
+	if m.log != nil {
+		if m.size != size {
+			// The table grew while displacing other entries, moving the entry.
+			dist = m.find(k).dist
+		}
+		m.log.add(LoggedOp{Op: OpPut, Key: k, Dist: dist})
+	}
+	m.endWrite()
+}
+
+// PutIfAbsent inserts the entry for the specified key if the key is not
+// already present, returning true if the entry was inserted. The value of an
+// existing entry is left intact.
+func (m *robinHoodMap) PutIfAbsent(k uint64, v unsafe.Pointer) bool {
+	m.beginWrite()
+	inserted, _ := m.put(k, v, false)
+	if inserted {
+		m.logPut(k)
+	}
+	m.endWrite()
+	return inserted
+}
+
+// PutDist is like Put, but returns the distance of the entry for the key from
+// its desired slot once the insertion or update is complete.
+func (m *robinHoodMap) PutDist(k uint64, v unsafe.Pointer) uint32 {
+	m.beginWrite()
+	size := m.size
+	_, dist := m.put(k, v, true)
+	if m.size != size {
+		// The table grew while displacing other entries, moving the entry.
+		dist = m.find(k).dist
+	}
+	m.logOp(OpPut, k, dist)
+	m.endWrite()
+	return dist
+}
+
+// slotPlaceholder is the value of an entry inserted by PutSlot until the
+// caller writes the real value.
+var slotPlaceholder byte
+
+// PutSlot inserts an entry for the specified key if it is not already present
+// and returns a pointer to its value, allowing the value to be written in
+// place. A newly inserted entry holds a placeholder value which the caller
+// must overwrite with a non-nil value before any other operation on the map:
+// a nil value marks an empty slot. The pointer is invalidated by the next
+// mutation of the map, since inserting or deleting any key may move entries,
+// and must not be retained or written through after that.
+func (m *robinHoodMap) PutSlot(k uint64) *unsafe.Pointer {
+	m.beginWrite()
+	m.put(k, unsafe.Pointer(&slotPlaceholder), false)
+	e := m.find(k)
+	m.logOp(OpPut, k, e.dist)
+	m.endWrite()
+	return &e.value
+}
+
+// maxTryPutGrowths is the number of times TryPut will grow the table for a
+// single insertion before giving up.
+const maxTryPutGrowths = 4
+
+// TryPut is like Put, but returns an error rather than growing the table more
+// than maxTryPutGrowths times for a single insertion. This guards against
+// adversarial key sets that collide at every table size. The map is left
+// unchanged when an error is returned.
+func (m *robinHoodMap) TryPut(k uint64, v unsafe.Pointer) error {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	m.beginWrite()
+	if m.fits(k) {
+		m.put(k, v, true)
+		m.logPut(k)
+		m.endWrite()
+		return nil
+	}
+	if m.frozen {
+		m.endWrite()
+		return fmt.Errorf("robinHoodMap: inserting key %d requires growing a frozen map", k)
+	}
+
+	// Build each grown table on the side so that the map is untouched if none
+	// of them can hold the entries.
+	size := m.size
+	for i := 0; i < maxTryPutGrowths; i++ {
+		size = grownSize(size, m.opts.growth)
+		if t := m.tryRehash(size); t != nil && t.fits(k) {
+			t.put(k, v, true)
+			if m.opts.onGrow != nil {
+				m.opts.onGrow(m.size, t.size)
+			}
+			if !m.shared {
+				m.freeEntries(m.entries)
+			}
+			m.entries, m.entriesPtr, m.occupied = t.entries, t.entriesPtr, t.occupied
+			m.size, m.shift, m.count, m.maxDist = t.size, t.shift, t.count, t.maxDist
+			m.shared = false
+			m.popPos = 0
+			// Every entry moved, as in rehash.
+			m.generation++
+			m.logPut(k)
+			m.endWrite()
+			return nil
+		}
+	}
+	m.endWrite()
+	return fmt.Errorf("robinHoodMap: inserting key %d requires growing the table more than %d times",
+		k, maxTryPutGrowths)
+}
+
+// tryRehash returns a copy of the map with a table of the specified size, or
+// nil if the entries do not fit without growing it further.
+func (m *robinHoodMap) tryRehash(size uint32) *robinHoodMap {
+	t := &robinHoodMap{opts: m.opts, hasher: m.hasher}
+	t.rehash(size)
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.value == nil {
+			continue
+		}
+		if !t.fits(e.key) {
+			return nil
+		}
+		t.put(e.key, e.value, true)
+		// The work of an abandoned attempt is counted too.
+		m.rehashWork++
+	}
+	return t
+}
+
+// fits returns whether put can insert or update the specified key without
+// growing the table. It simulates put without modifying the table, which is
+// possible because insertion only ever writes to slots it has already
+// passed.
+func (m *robinHoodMap) fits(k uint64) bool {
+	n := robinHoodEntry{key: k, dist: 0}
+	for i := m.hash(n.key); ; i++ {
+		e := m.entry(i)
+		if e.value == nil || e.key == n.key {
+			return true
+		}
+		if e.dist < n.dist {
+			n = *e
+		}
+		n.dist++
+		if n.dist == m.maxDist {
+			return false
+		}
+	}
+}
+
+// put inserts the entry for the specified key, returning false if the key was
+// already present. The value of an existing entry is only replaced if
+// overwrite is true. The returned distance is how far the probe walked from
+// the desired slot of the key to find it or the slot to insert it at.
+func (m *robinHoodMap) put(k uint64, v unsafe.Pointer, overwrite bool) (inserted bool, dist uint32) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	if m.frozen && !m.fits(k) {
+		// Inserting the key would grow the table after displacing entries,
+		// which a panic from the growth would lose.
+		m.panicFrozen()
+	}
+	if m.shared {
+		m.unshare()
+	}
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if e.value == nil || e.dist < dist {
+			// The key is not present: an existing entry would have been found
+			// before an empty entry or an entry which is richer than us.
+			if m.maybeGrowForLoad() {
+				i = m.hash(k) - 1
+				dist = 0
+				continue
+			}
+			m.insertAt(i, robinHoodEntry{key: k, value: v, dist: dist})
+			return true, dist
+		}
+
+		if e.key == k {
+			// Found an existing entry.
+			if overwrite && e.value != v {
+				old := e.value
+				e.value = v
+				m.evict(k, old)
+			}
+			return false, dist
+		}
+
+		// If we've reached the max distance threshold without finding the key,
+		// grow the table and restart.
+		dist++
+		if dist == m.maxDist {
+			m.grow()
+			i = m.hash(k) - 1
+			dist = 0
+		}
+	}
+}
+
+// insertAt inserts n, which is known not to be present, at slot i where n.dist
+// is its distance from its desired slot. Slot i must either be empty or hold
+// an entry which is richer than n.
+func (m *robinHoodMap) insertAt(i uint32, n robinHoodEntry) {
+	for ; ; i++ {
 		e := m.entry(i)
 		if e.value == nil {
 			// Found an empty entry: insert here.
 			*e = n
+			m.setOccupied(i)
 			m.count++
+			m.generation++
 			return
 		}
 
@@ -140,6 +1064,7 @@ func (m *robinHoodMap) Put(k uint64, v unsafe.Pointer) {
 			// rich. We then continue to loop, looking for a new location for the
 			// current entry.
 			n, *e = *e, n
+			m.swapCount++
 		}
 
 		// The new entry gradually moves away from its ideal position.
@@ -148,59 +1073,1242 @@ func (m *robinHoodMap) Put(k uint64, v unsafe.Pointer) {
 		// If we've reached the max distance threshold, grow the table and restart
 		// the insertion.
 		if n.dist == m.maxDist {
-			m.rehash(2 * m.size)
-			i = hash(e.key, m.shift) - 1
+			m.grow()
+			// Restart from the desired slot of the entry we're carrying, which may
+			// no longer be the entry we started inserting if a swap occurred.
+			i = m.hash(n.key) - 1
 			n.dist = 0
 		}
 	}
 }
 
+// PutSwaps is like Put, but returns the number of entries displaced by the
+// insertion, including any displaced while reinserting the entries if the
+// table grows. Replacing the value of an existing key displaces nothing.
+func (m *robinHoodMap) PutSwaps(k uint64, v unsafe.Pointer) int {
+	before := m.swapCount
+	m.Put(k, v)
+	return int(m.swapCount - before)
+}
+
+// SwapCount returns the number of times an insertion has displaced a richer
+// entry over the lifetime of the map, counting the reinsertions of rehashes.
+// It measures how much Robin Hood stealing the workload causes.
+func (m *robinHoodMap) SwapCount() uint64 {
+	return m.swapCount
+}
+
+// GetOrCompute returns the value for the specified key if it is present.
+// Otherwise it inserts and returns the (non-nil) value returned by compute.
+// compute is only called if the key is absent, and must not mutate the map.
+// The probe which determines that the key is absent also locates the slot the
+// new entry is inserted at.
+func (m *robinHoodMap) GetOrCompute(k uint64, compute func() unsafe.Pointer) unsafe.Pointer {
+	var dist uint32
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if e.value == nil || e.dist < dist {
+			v := compute()
+			if v == nil {
+				panic("robinHoodMap: nil value")
+			}
+			m.beginWrite()
+			if m.frozen && !m.fits(k) {
+				m.panicFrozen()
+			}
+			if m.shared {
+				m.unshare()
+			}
+			if m.maybeGrowForLoad() {
+				m.put(k, v, true)
+			} else {
+				m.insertAt(i, robinHoodEntry{key: k, value: v, dist: dist})
+			}
+			m.logPut(k)
+			m.endWrite()
+			return v
+		}
+		if e.key == k {
+			return e.value
+		}
+		dist++
+		if dist == m.maxDist {
+			// The key is absent, but inserting it requires growing the table.
+			v := compute()
+			if v == nil {
+				panic("robinHoodMap: nil value")
+			}
+			m.beginWrite()
+			m.put(k, v, true)
+			m.logPut(k)
+			m.endWrite()
+			return v
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+//
+// The probe loop is not bounds checked. It relies on the invariant, enforced
+// by put growing the table, that every entry is less than maxDist from its
+// desired slot. Once dist reaches maxDist the "dist > e.dist" check is
+// guaranteed to terminate the loop, and the desired slot is at most size-1, so
+// the last slot examined is at most size-1+maxDist: the sentinel.
+//
+// Get is too large to be inlined into its callers, which Go limits to a cost
+// of 80, so the aim is instead that everything it calls is inlined into it:
+// hash, (*robinHoodMap).hash and entry are each within budget and contain no
+// loops, defers or calls which are not themselves inlined. The probe loop has
+// a single exit so the hook is called from one place, off the hot path. Check
+// with "go build -gcflags=-m" after changing any of these functions.
 func (m *robinHoodMap) Get(k uint64) unsafe.Pointer {
 	var dist uint32
-	for i := hash(k, m.shift); ; i++ {
+	var v unsafe.Pointer
+	for i := m.hash(k); ; i++ {
 		e := m.entry(i)
 		if k == e.key {
 			// Found.
+			v = e.value
+			break
+		}
+		if dist > e.dist {
+			// Not found.
+			break
+		}
+		dist++
+	}
+	if m.opts.onProbe != nil {
+		m.opts.onProbe(OpGet, dist)
+	}
+	return v
+}
+
+// GetKnown returns the value for the specified key, which must be present. It
+// is a fast path for lookups which are known to hit: the probe loop tests
+// only for a matching key and omits the "dist > e.dist" check which
+// terminates a miss. A match needs no value check because the slots between
+// the desired slot of a present key and its entry are never empty. When
+// built with the maptoy_debug tag, GetKnown panics if the key is absent.
+// Otherwise, the probe for an absent key is unbounded and may read beyond the
+// end of the entries.
+func (m *robinHoodMap) GetKnown(k uint64) unsafe.Pointer {
+	if debugChecks {
+		if m.find(k) == nil {
+			panic(fmt.Sprintf("robinHoodMap: GetKnown of absent key %d", k))
+		}
+	}
+	for i := m.hash(k); ; i++ {
+		if e := m.entry(i); k == e.key {
 			return e.value
 		}
+	}
+}
+
+// Peek returns the value for the specified key along with its distance from
+// its desired slot, and whether the key was present. On a miss, dist is the
+// distance walked before the probe terminated. Unlike Get, Peek does not call
+// the probe hook.
+func (m *robinHoodMap) Peek(k uint64) (value unsafe.Pointer, dist uint32, ok bool) {
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return e.value, dist, true
+		}
 		if dist > e.dist {
 			// Not found.
-			return nil
+			return nil, dist, false
 		}
 		dist++
 	}
 }
 
-func (m *robinHoodMap) Delete(k uint64) {
+// GetBounded is like Get, but examines at most maxProbes slots, bounding the
+// latency of a lookup of a key in a long chain. It returns the value and
+// whether the key was found, or gaveUp set if the lookup had not resolved
+// after maxProbes slots, in which case the key may or may not be present. A
+// lookup examines the slots listed by ProbeSequence, so it resolves if
+// maxProbes is at least MaxDist()+2.
+func (m *robinHoodMap) GetBounded(k uint64, maxProbes uint32) (v unsafe.Pointer, found, gaveUp bool) {
 	var dist uint32
-	for i := hash(k, m.shift); ; i++ {
+	for i := m.hash(k); ; i++ {
+		if dist == maxProbes {
+			return nil, false, true
+		}
 		e := m.entry(i)
-		if k == e.key {
-			// We found the entry to delete. Shift the following entries backwards
-			// until the next empty value or entry with a zero distance. Note that
-			// empty values are guaranteed to have "dist == 0".
-			m.count--
-			for j := i + 1; ; j++ {
-				t := m.entry(j)
-				if t.dist == 0 {
-					*e = robinHoodEntry{}
-					return
-				}
-				e.key = t.key
-				e.value = t.value
-				e.dist = t.dist - 1
-				e = t
-			}
+		if k == e.key && e.value != nil {
+			// Found.
+			return e.value, true, false
 		}
 		if dist > e.dist {
 			// Not found.
-			return
+			return nil, false, false
 		}
 		dist++
 	}
 }
 
-func (m *robinHoodMap) String() string {
+// ProbeSequence returns the slots visited by Get for the specified key, in
+// order, ending with the slot holding the key or the slot at which the probe
+// determined that the key is absent. It is intended for debugging why a key
+// lies far from its desired slot.
+func (m *robinHoodMap) ProbeSequence(k uint64) []uint32 {
+	var slots []uint32
+	var dist uint32
+	for i := m.hash(k); ; i++ {
+		slots = append(slots, i)
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return slots
+		}
+		if dist > e.dist {
+			// Not found.
+			return slots
+		}
+		dist++
+	}
+}
+
+// SlotInfo returns the desired slot of the specified key, the slot its entry
+// occupies and its distance from the desired slot, which is actual-desired.
+// It returns false if the key is not present, in which case only desired is
+// meaningful.
+func (m *robinHoodMap) SlotInfo(k uint64) (desired, actual uint32, dist uint32, ok bool) {
+	desired = m.hash(k)
+	for i := desired; ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return desired, i, e.dist, true
+		}
+		if i-desired > e.dist {
+			// Not found.
+			return desired, 0, 0, false
+		}
+	}
+}
+
+// containsGroup is the number of keys whose desired slots containsBatch
+// loads together.
+const containsGroup = 8
+
+// ContainsAll returns whether every key in keys is present. It returns true
+// for an empty slice and stops at the first absent key.
+func (m *robinHoodMap) ContainsAll(keys []uint64) bool {
+	return m.containsBatch(keys, false)
+}
+
+// ContainsAny returns whether any key in keys is present. It returns false
+// for an empty slice and stops at the first present key.
+func (m *robinHoodMap) ContainsAny(keys []uint64) bool {
+	return m.containsBatch(keys, true)
+}
+
+// containsBatch returns stop if the presence of some key in keys equals stop,
+// and !stop otherwise. Go has no prefetch intrinsic, so the keys are
+// processed in groups whose desired slots are loaded in a separate loop
+// before any of them are probed. The loads are independent, so their cache
+// misses overlap rather than being serialized behind the probe of each key.
+func (m *robinHoodMap) containsBatch(keys []uint64, stop bool) bool {
+	var slots [containsGroup]uint32
+	var first [containsGroup]robinHoodEntry
+	for len(keys) > 0 {
+		group := keys
+		if len(group) > containsGroup {
+			group = group[:containsGroup]
+		}
+		keys = keys[len(group):]
+		for j, k := range group {
+			slots[j] = m.hash(k)
+			first[j] = *m.entry(slots[j])
+		}
+		for j, k := range group {
+			var present bool
+			if e := &first[j]; k == e.key && e.value != nil {
+				present = true
+			} else if e.value != nil {
+				present = m.findFrom(k, slots[j]+1, 1) != nil
+			}
+			if present == stop {
+				return stop
+			}
+		}
+	}
+	return !stop
+}
+
+// GetMany returns a map holding the keys in keys which are present, along
+// with their values. Absent keys are omitted. The entries found are
+// remembered on a first pass so that the result can be sized to the number
+// of hits without probing each key twice.
+func (m *robinHoodMap) GetMany(keys []uint64) map[uint64]unsafe.Pointer {
+	found := make([]*robinHoodEntry, len(keys))
+	var hits int
+	for i, k := range keys {
+		if e := m.find(k); e != nil {
+			found[i] = e
+			hits++
+		}
+	}
+	result := make(map[uint64]unsafe.Pointer, hits)
+	for _, e := range found {
+		if e != nil {
+			result[e.key] = e.value
+		}
+	}
+	return result
+}
+
+// find returns the entry for the specified key, or nil if the key is not
+// present. Empty entries have a zero key, so a match also requires a non-nil
+// value.
+func (m *robinHoodMap) find(k uint64) *robinHoodEntry {
+	return m.findFrom(k, m.hash(k), 0)
+}
+
+// findFrom is like find, but starts probing at slot i, which is dist from the
+// desired slot of the key.
+func (m *robinHoodMap) findFrom(k uint64, i, dist uint32) *robinHoodEntry {
+	for ; ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return e
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// CompareAndSwap replaces the value for the specified key with new if the key
+// is present and its value is old, returning true if the swap was
+// performed. The key is never inserted if it is absent. The new value must not
+// be nil.
+func (m *robinHoodMap) CompareAndSwap(k uint64, old, new unsafe.Pointer) bool {
+	if new == nil {
+		panic("robinHoodMap: nil value")
+	}
+	m.beginWrite()
+	e := m.find(k)
+	if e == nil || e.value != old {
+		m.endWrite()
+		return false
+	}
+	if m.shared {
+		m.unshare()
+		e = m.find(k)
+	}
+	e.value = new
+	if new != old {
+		m.evict(k, old)
+	}
+	m.logOp(OpPut, k, e.dist)
+	m.endWrite()
+	return true
+}
+
+// Swap sets the value for the specified key, returning the previous value and
+// true if the key was present, and nil and false if it was inserted. As in
+// GetOrCompute, a single probe either finds the key or locates the slot to
+// insert it at. The value must not be nil.
+func (m *robinHoodMap) Swap(k uint64, v unsafe.Pointer) (old unsafe.Pointer, loaded bool) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	m.beginWrite()
+	if m.frozen && !m.fits(k) {
+		m.panicFrozen()
+	}
+	if m.shared {
+		m.unshare()
+	}
+	var dist uint32
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if e.value == nil || e.dist < dist {
+			if m.maybeGrowForLoad() {
+				m.put(k, v, true)
+			} else {
+				m.insertAt(i, robinHoodEntry{key: k, value: v, dist: dist})
+			}
+			break
+		}
+		if e.key == k {
+			old, loaded = e.value, true
+			e.value = v
+			break
+		}
+		dist++
+		if dist == m.maxDist {
+			// The key is absent, but inserting it requires growing the table.
+			m.put(k, v, true)
+			break
+		}
+	}
+	m.logPut(k)
+	m.endWrite()
+	return old, loaded
+}
+
+func (m *robinHoodMap) Delete(k uint64) {
+	m.beginWrite()
+	var dist uint32
+	// As in Get, the probe loop has a single exit.
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			v := e.value
+			m.removeAt(i)
+			m.evict(k, v)
+			if m.opts.shrinkBelow > 0 {
+				m.maybeShrink()
+			}
+			break
+		}
+		if dist > e.dist {
+			// Not found.
+			break
+		}
+		dist++
+	}
+	if m.opts.onProbe != nil {
+		m.opts.onProbe(OpDelete, dist)
+	}
+	m.logOp(OpDelete, k, dist)
+	m.endWrite()
+}
+
+// LoadAndDelete removes the entry for the specified key, returning its value
+// and true if the key was present, and nil and false otherwise.
+func (m *robinHoodMap) LoadAndDelete(k uint64) (unsafe.Pointer, bool) {
+	m.beginWrite()
+	var dist uint32
+	for i := m.hash(k); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			v := e.value
+			m.removeAt(i)
+			m.logOp(OpDelete, k, dist)
+			if m.opts.shrinkBelow > 0 {
+				m.maybeShrink()
+			}
+			m.endWrite()
+			return v, true
+		}
+		if dist > e.dist {
+			// Not found.
+			m.endWrite()
+			return nil, false
+		}
+		dist++
+	}
+}
+
+// DeleteBatch removes every present key in keys, returning the number of
+// entries removed. Keys that are absent or repeated are ignored. The keys are
+// deleted in decreasing order of their desired slot: removing an entry only
+// shifts the entries after it, so deleting from the back of a chain first
+// avoids shifting entries that are about to be deleted anyway. The keys slice
+// is not modified.
+func (m *robinHoodMap) DeleteBatch(keys []uint64) int {
+	sorted := make([]uint64, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return m.hash(sorted[i]) > m.hash(sorted[j])
+	})
+
+	m.beginWrite()
+	var removed int
+	for _, k := range sorted {
+		var dist uint32
+		for i := m.hash(k); ; i++ {
+			e := m.entry(i)
+			if k == e.key && e.value != nil {
+				v := e.value
+				m.removeAt(i)
+				m.evict(k, v)
+				m.logOp(OpDelete, k, dist)
+				removed++
+				break
+			}
+			if dist > e.dist {
+				// Not found.
+				break
+			}
+			dist++
+		}
+	}
+	if removed > 0 && m.opts.shrinkBelow > 0 {
+		m.maybeShrink()
+	}
+	m.endWrite()
+	return removed
+}
+
+// SubtractKeys removes every key of other from the map, returning the number
+// of entries removed. The entries of other are walked once, in slot order,
+// and each is deleted from the map with a backward shift as in Delete.
+// Subtracting a map from itself clears it.
+func (m *robinHoodMap) SubtractKeys(other *robinHoodMap) int {
+	if other == m {
+		n := m.Len()
+		m.Clear()
+		return n
+	}
+	m.beginWrite()
+	var removed int
+	for i := range other.entries {
+		e := &other.entries[i]
+		if e.value == nil {
+			continue
+		}
+		if _, slot, dist, ok := m.SlotInfo(e.key); ok {
+			v := m.entry(slot).value
+			m.removeAt(slot)
+			m.evict(e.key, v)
+			m.logOp(OpDelete, e.key, dist)
+			removed++
+		}
+	}
+	if removed > 0 && m.opts.shrinkBelow > 0 {
+		m.maybeShrink()
+	}
+	m.endWrite()
+	return removed
+}
+
+// Intersect returns a new map holding the keys present in both the map and
+// other, with the values and the options and hash of the map. The entries of
+// the smaller of the two are walked and probed for in the larger, and the new
+// map is sized for the smaller, so the work is bounded by the smaller input.
+func (m *robinHoodMap) Intersect(other *robinHoodMap) *robinHoodMap {
+	small, large := m, other
+	if other.count < m.count {
+		small, large = other, m
+	}
+	result := newRobinHoodMapWithOptions(small.Len(), m.opts)
+	result.hasher = m.hasher
+	for i := range small.entries {
+		e := &small.entries[i]
+		if e.value == nil {
+			continue
+		}
+		if f := large.find(e.key); f != nil {
+			v := e.value
+			if small != m {
+				v = f.value
+			}
+			result.put(e.key, v, true)
+		}
+	}
+	return result
+}
+
+// Diff compares the map against old, such as an earlier copy of it. It
+// returns the keys present in the map but not in old, the keys present in
+// old but not in the map, and the keys present in both whose values differ,
+// compared by pointer identity. Each slice is sorted in ascending order.
+func (m *robinHoodMap) Diff(old *robinHoodMap) (added, removed, changed []uint64) {
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.value == nil {
+			continue
+		}
+		if f := old.find(e.key); f == nil {
+			added = append(added, e.key)
+		} else if f.value != e.value {
+			changed = append(changed, e.key)
+		}
+	}
+	for i := range old.entries {
+		e := &old.entries[i]
+		if e.value != nil && m.find(e.key) == nil {
+			removed = append(removed, e.key)
+		}
+	}
+	for _, keys := range [][]uint64{added, removed, changed} {
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	}
+	return added, removed, changed
+}
+
+// RemoveIf deletes every entry for which pred returns true, returning the
+// number of entries removed. The map must not be mutated by pred.
+func (m *robinHoodMap) RemoveIf(pred func(key uint64, value unsafe.Pointer) bool) int {
+	return m.removeWhere(pred, true)
+}
+
+// RetainIf deletes every entry for which pred returns false, returning the
+// number of entries removed. The map must not be mutated by pred.
+func (m *robinHoodMap) RetainIf(pred func(key uint64, value unsafe.Pointer) bool) int {
+	return m.removeWhere(pred, false)
+}
+
+// removeWhere deletes every entry for which pred returns remove. Removing an
+// entry shifts the following entries backwards, so the scan examines the same
+// slot again rather than advancing. Entries only ever shift backwards, so
+// every entry is examined exactly once.
+func (m *robinHoodMap) removeWhere(pred func(key uint64, value unsafe.Pointer) bool, remove bool) int {
+	m.beginWrite()
+	var removed int
+	for i := uint32(0); i < uint32(len(m.entries)); {
+		e := m.entry(i)
+		if e.value != nil && pred(e.key, e.value) == remove {
+			k, v, dist := e.key, e.value, e.dist
+			m.removeAt(i)
+			m.evict(k, v)
+			m.logOp(OpDelete, k, dist)
+			removed++
+			continue
+		}
+		i++
+	}
+	if removed > 0 && m.opts.shrinkBelow > 0 {
+		m.maybeShrink()
+	}
+	m.endWrite()
+	return removed
+}
+
+// RangeMutate calls f for each entry in the map, replacing the value of the
+// entry with the returned value if keep is true and deleting the entry if
+// keep is false. The returned value must not be nil if keep is true. Each
+// entry is visited exactly once: as in removeWhere, a deletion shifts only
+// entries which have not yet been visited back into the current slot, which
+// is then examined again. The map must not be mutated by f.
+func (m *robinHoodMap) RangeMutate(f func(key uint64, value unsafe.Pointer) (newValue unsafe.Pointer, keep bool)) {
+	m.beginWrite()
+	var removed bool
+	for i := uint32(0); i < uint32(len(m.entries)); {
+		e := m.entry(i)
+		if e.value == nil {
+			i++
+			continue
+		}
+		k, old, dist := e.key, e.value, e.dist
+		v, keep := f(k, old)
+		if !keep {
+			m.removeAt(i)
+			m.evict(k, old)
+			m.logOp(OpDelete, k, dist)
+			removed = true
+			continue
+		}
+		if v == nil {
+			panic("robinHoodMap: nil value")
+		}
+		if v != e.value {
+			if m.shared {
+				m.unshare()
+				e = m.entry(i)
+			}
+			e.value = v
+			m.evict(k, old)
+			m.logOp(OpPut, k, dist)
+		}
+		i++
+	}
+	if removed && m.opts.shrinkBelow > 0 {
+		m.maybeShrink()
+	}
+	m.endWrite()
+}
+
+// PopAny removes and returns an arbitrary entry, returning false if the map is
+// empty. The scan resumes from the slot of the previous pop, so draining the
+// map with repeated calls examines each slot a constant number of times.
+func (m *robinHoodMap) PopAny() (key uint64, value unsafe.Pointer, ok bool) {
+	if m.count == 0 {
+		return 0, nil, false
+	}
+	m.beginWrite()
+	n := uint32(len(m.entries))
+	for i := m.popPos; ; i++ {
+		if i == n {
+			i = 0
+		}
+		if e := m.entry(i); e.value != nil {
+			key, value = e.key, e.value
+			dist := e.dist
+			// The next entry may shift into this slot, so resume the next scan here.
+			m.removeAt(i)
+			m.logOp(OpDelete, key, dist)
+			m.popPos = i
+			if m.opts.shrinkBelow > 0 {
+				// A shrink rehashes, which resets popPos.
+				m.maybeShrink()
+			}
+			m.endWrite()
+			return key, value, true
+		}
+	}
+}
+
+// evict calls the onEvict hook, if any, for a value dropped by the map.
+func (m *robinHoodMap) evict(k uint64, v unsafe.Pointer) {
+	if m.opts.onEvict != nil {
+		m.opts.onEvict(k, v)
+	}
+}
+
+// evictAll calls the onEvict hook, if any, for every entry, before the
+// entries are dropped wholesale.
+func (m *robinHoodMap) evictAll() {
+	if m.opts.onEvict == nil {
+		return
+	}
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			m.opts.onEvict(e.key, e.value)
+		}
+	}
+}
+
+// removeAt removes the entry at index i. The following entries are shifted
+// backwards until the next empty value or entry with a zero distance. Note
+// that empty values are guaranteed to have "dist == 0". The removed value is
+// overwritten by the shift, and the last slot of the shifted run, which would
+// otherwise hold a stale copy of the pointer shifted out of it, is zeroed, so
+// no slot retains a pointer to the removed value and the garbage collector
+// can reclaim it.
+func (m *robinHoodMap) removeAt(i uint32) {
+	if m.shared {
+		m.unshare()
+	}
+	e := m.entry(i)
+	m.count--
+	m.generation++
+	for j := i + 1; ; j++ {
+		t := m.entry(j)
+		if t.dist == 0 {
+			*e = robinHoodEntry{}
+			m.clearOccupied(j - 1)
+			return
+		}
+		e.key = t.key
+		e.value = t.value
+		e.dist = t.dist - 1
+		e = t
+	}
+}
+
+// maybeShrink shrinks the table if a deletion has left its load factor below
+// opts.shrinkBelow and it is larger than its size at construction. A frozen
+// table is never shrunk. To avoid oscillating around the threshold, the new
+// size is chosen so that the load factor is at least twice the threshold, so
+// that a few more deletions do not shrink the table again, but no more than
+// sizeForCapacity allows, so that a few insertions do not grow it again. The
+// table is only ever rehashed to a strictly smaller size.
+func (m *robinHoodMap) maybeShrink() {
+	if m.frozen || float64(m.count) >= m.opts.shrinkBelow*float64(m.size) {
+		return
+	}
+	var size uint32
+	if target := float64(m.count) / (2 * m.opts.shrinkBelow); target >= 1 {
+		size = 1 << uint(bits.Len64(uint64(target))-1)
+	}
+	if min := sizeForCapacity(int(m.count)); size < min {
+		size = min
+	}
+	if size < m.minSize {
+		size = m.minSize
+	}
+	if size < m.size {
+		m.rehash(size)
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMap) Len() int {
+	return int(m.count)
+}
+
+// RecomputeCount resets the count of entries to the number of occupied slots,
+// returning the correction applied: the true count minus the count previously
+// recorded. It is a safety valve for count drift and an aid for tests.
+func (m *robinHoodMap) RecomputeCount() int {
+	var count uint32
+	for i := range m.entries {
+		if m.entries[i].value != nil {
+			count++
+		}
+	}
+	delta := int(count) - int(m.count)
+	m.count = count
+	return delta
+}
+
+// ToGoMap returns a Go map holding a copy of the entries of the map.
+func (m *robinHoodMap) ToGoMap() map[uint64]unsafe.Pointer {
+	dst := make(map[uint64]unsafe.Pointer, m.count)
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			dst[e.key] = e.value
+		}
+	}
+	return dst
+}
+
+// LoadFactor returns the ratio of entries to table size. It can exceed 1 since
+// entries may reside in the padding past the end of the table.
+func (m *robinHoodMap) LoadFactor() float64 {
+	return float64(m.count) / float64(m.size)
+}
+
+// MaxDist returns the largest distance of any entry from its desired slot.
+func (m *robinHoodMap) MaxDist() uint32 {
+	var max uint32
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil && e.dist > max {
+			max = e.dist
+		}
+	}
+	return max
+}
+
+// MaxRun returns the length of the longest run of consecutive occupied slots.
+// A run is what a miss probing into it may have to walk, and long runs are a
+// sign of clustering. It complements MaxDist as a diagnostic: keys at
+// adjacent desired slots form a run although none is displaced.
+func (m *robinHoodMap) MaxRun() uint32 {
+	var max, run uint32
+	for i := range m.entries {
+		if m.entries[i].value == nil {
+			run = 0
+			continue
+		}
+		run++
+		if run > max {
+			max = run
+		}
+	}
+	return max
+}
+
+// NeedsGrow returns true if the next insertion may grow the table. An
+// insertion increases the distance of any entry by at most 1, so the table
+// can only grow once some entry is within 1 of maxDist. This makes NeedsGrow
+// conservative: the next insertion often fits regardless. NeedsGrow scans the
+// entries and is intended to be called off the hot path, for example to
+// decide whether to Reserve during an idle period. With a load factor
+// ceiling, NeedsGrow is also true if the next insertion would exceed it.
+func (m *robinHoodMap) NeedsGrow() bool {
+	return m.overLoad() || m.MaxDist()+1 >= m.maxDist
+}
+
+// CountAtLeastDist returns the number of entries at distance d or more from
+// their desired slots. Entries close to maxDist indicate that an insertion
+// is likely to grow the table soon.
+func (m *robinHoodMap) CountAtLeastDist(d uint32) int {
+	var n int
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil && e.dist >= d {
+			n++
+		}
+	}
+	return n
+}
+
+// AvgDist returns the average distance of the entries from their desired
+// slots.
+func (m *robinHoodMap) AvgDist() float64 {
+	if m.count == 0 {
+		return 0
+	}
+	var total uint64
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			total += uint64(e.dist)
+		}
+	}
+	return float64(total) / float64(m.count)
+}
+
+// MemoryUsage returns the approximate number of bytes used by the map.
+func (m *robinHoodMap) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*m)) + uint64(cap(m.entries))*uint64(unsafe.Sizeof(robinHoodEntry{}))
+}
+
+// RehashWork returns the number of entries reinserted by rehashes over the
+// lifetime of the map, including those performed by Reserve, Compact and
+// ResizeTo. Divided by Len, it gives the amortized number of times each entry
+// has been moved by growth.
+func (m *robinHoodMap) RehashWork() uint64 {
+	return m.rehashWork
+}
+
+// Generation returns a counter which changes whenever entries are added,
+// removed or moved, including by a rehash. Replacing the value of an existing
+// key does not change it. Iteration state captured at one generation is
+// invalid at any other.
+func (m *robinHoodMap) Generation() uint64 {
+	return m.generation
+}
+
+// MapStats holds diagnostics about a robinHoodMap. See the accessors of the
+// same names for the meaning of each field.
+type MapStats struct {
+	Count       int
+	Size        uint32
+	LoadFactor  float64
+	MaxDist     uint32
+	AvgDist     float64
+	MemoryUsage uint64
+}
+
+// Stats returns diagnostics about the map, computing the distance statistics
+// in a single pass over the entries.
+func (m *robinHoodMap) Stats() MapStats {
+	s := MapStats{
+		Count:       m.Len(),
+		Size:        m.size,
+		LoadFactor:  m.LoadFactor(),
+		MemoryUsage: m.MemoryUsage(),
+	}
+	var total uint64
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			total += uint64(e.dist)
+			if e.dist > s.MaxDist {
+				s.MaxDist = e.dist
+			}
+		}
+	}
+	if m.count > 0 {
+		s.AvgDist = float64(total) / float64(m.count)
+	}
+	return s
+}
+
+// Keys returns the keys of all of the entries in the map. The order of the
+// keys is unspecified.
+func (m *robinHoodMap) Keys() []uint64 {
+	keys := make([]uint64, 0, m.count)
+	if m.occupied != nil {
+		for i := nextOccupied(m.occupied, 0); i >= 0; i = nextOccupied(m.occupied, i+1) {
+			keys = append(keys, m.entries[i].key)
+		}
+		return keys
+	}
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// KeysForValue returns the keys of the entries whose value is v, compared by
+// pointer identity. It scans every slot, and is intended for diagnostics such
+// as finding which keys refer to an object. The order of the keys is
+// unspecified.
+func (m *robinHoodMap) KeysForValue(v unsafe.Pointer) []uint64 {
+	var keys []uint64
+	if v == nil {
+		return keys
+	}
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value == v {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// SortedKeys returns the keys of all of the entries in the map in ascending
+// order.
+func (m *robinHoodMap) SortedKeys() []uint64 {
+	keys := m.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// Range calls f for each entry in the map. The order of iteration is
+// unspecified. If f returns false, iteration stops.
+func (m *robinHoodMap) Range(f func(key uint64, value unsafe.Pointer) bool) {
+	if m.occupied != nil {
+		for i := nextOccupied(m.occupied, 0); i >= 0; i = nextOccupied(m.occupied, i+1) {
+			if e := &m.entries[i]; !f(e.key, e.value) {
+				return
+			}
+		}
+		return
+	}
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			if !f(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// RangeByDesiredSlot calls f for each entry in the map in non-decreasing order
+// of the desired slot of its key, such as to export the entries into another
+// table with good insertion locality. The order of entries sharing a desired
+// slot is unspecified. The table never wraps around, and Robin Hood insertion
+// keeps the entries sorted by desired slot: an entry is at most one slot
+// further from its desired slot than its predecessor, and an entry following
+// an empty slot is in its desired slot. Physical order is therefore desired
+// slot order, and no sorting is needed. The map must not be mutated by f.
+func (m *robinHoodMap) RangeByDesiredSlot(f func(key uint64, value unsafe.Pointer)) {
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			f(e.key, e.value)
+		}
+	}
+}
+
+// RangeSlots calls f for every slot of the table in physical order, including
+// empty slots, the padding beyond size and the trailing sentinel. Empty slots
+// are reported with a nil value. If f returns false, iteration stops. It is
+// intended for tools which visualize the layout of the table.
+func (m *robinHoodMap) RangeSlots(f func(slot uint32, key uint64, value unsafe.Pointer, dist uint32) bool) {
+	for i := range m.entries {
+		e := &m.entries[i]
+		if !f(uint32(i), e.key, e.value, e.dist) {
+			return
+		}
+	}
+}
+
+// RangeFrom calls f for up to limit entries, in slot order starting at slot
+// cursor, returning the slot to resume from and whether every slot has been
+// visited. Paginating with RangeFrom from a cursor of 0 visits each entry
+// exactly once, provided the map is not mutated between calls. A cursor is
+// only meaningful for the table it was returned from. When built with the
+// maptoy_debug tag, resuming from a non-zero cursor after the map has been
+// mutated panics. Callers which hand cursors to other processes can record
+// Generation alongside the cursor to detect this themselves.
+func (m *robinHoodMap) RangeFrom(
+	cursor uint32, limit int, f func(key uint64, value unsafe.Pointer),
+) (next uint32, done bool) {
+	if debugChecks && cursor != 0 && m.generation != m.cursorGeneration {
+		panic("robinHoodMap: map mutated during iteration")
+	}
+	n := uint32(len(m.entries))
+	for ; cursor < n && limit > 0; cursor++ {
+		if e := &m.entries[cursor]; e.value != nil {
+			f(e.key, e.value)
+			limit--
+		}
+	}
+	if debugChecks {
+		m.cursorGeneration = m.generation
+	}
+	return cursor, cursor >= n
+}
+
+// RangeSorted calls f for each entry in the map in ascending key order. If f
+// returns false, iteration stops.
+func (m *robinHoodMap) RangeSorted(f func(key uint64, value unsafe.Pointer) bool) {
+	sorted := make([]robinHoodEntry, 0, m.count)
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			sorted = append(sorted, *e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+	for i := range sorted {
+		if !f(sorted[i].key, sorted[i].value) {
+			return
+		}
+	}
+}
+
+// mapIterator is a pull-based iterator over the entries of a robinHoodMap. The
+// iterator remembers its position in the entries slice and skips over empty
+// slots, visiting each entry exactly once. Mutating the map while iterating
+// invalidates the iterator: entries may be skipped or visited more than once.
+// When built with the maptoy_debug tag, Next panics if the map has been
+// mutated since the iterator was created.
+type mapIterator struct {
+	m          *robinHoodMap
+	generation uint64
+	entries    []robinHoodEntry
+	occupied   []uint64
+	pos        int
+	cur        *robinHoodEntry
+}
+
+// Iterator returns an iterator positioned before the first entry in the
+// map. Next must be called to advance to the first entry.
+func (m *robinHoodMap) Iterator() *mapIterator {
+	return &mapIterator{m: m, generation: m.generation, entries: m.entries, occupied: m.occupied}
+}
+
+// Next advances the iterator to the next entry, returning false if there are
+// no more entries.
+func (it *mapIterator) Next() bool {
+	if debugChecks && it.m.generation != it.generation {
+		panic("robinHoodMap: map mutated during iteration")
+	}
+	if it.occupied != nil {
+		i := nextOccupied(it.occupied, it.pos)
+		if i < 0 {
+			it.pos = len(it.entries)
+			it.cur = nil
+			return false
+		}
+		it.pos = i + 1
+		it.cur = &it.entries[i]
+		return true
+	}
+	for it.pos < len(it.entries) {
+		e := &it.entries[it.pos]
+		it.pos++
+		if e.value != nil {
+			it.cur = e
+			return true
+		}
+	}
+	it.cur = nil
+	return false
+}
+
+// Key returns the key of the current entry.
+func (it *mapIterator) Key() uint64 {
+	return it.cur.key
+}
+
+// Value returns the value of the current entry.
+func (it *mapIterator) Value() unsafe.Pointer {
+	return it.cur.value
+}
+
+// hashQuality reports the max and average distance from their desired slots
+// of the specified keys if they were placed in a table of the specified size
+// using the hash function h, without building a map or applying a max
+// distance threshold. It is used to compare hash functions offline. Robin
+// Hood insertion keeps the entries sorted by desired slot, so rather than
+// simulating the swaps, each key is placed in desired slot order at the first
+// slot which is at or after its desired slot and after the previous key. This
+// produces the same layout as insertion in any order. The keys are assumed to
+// be distinct and size must be a power of 2.
+func hashQuality(keys []uint64, size uint32, h func(k uint64, shift uint32) uint32) (maxDist uint32, avgDist float64) {
+	if len(keys) == 0 {
+		return 0, 0
+	}
+	shift := uint32(64 - bits.Len32(size-1))
+	desired := make([]uint32, len(keys))
+	for i, k := range keys {
+		desired[i] = h(k, shift)
+	}
+	sort.Slice(desired, func(i, j int) bool { return desired[i] < desired[j] })
+
+	var total uint64
+	var next uint32
+	for _, d := range desired {
+		pos := d
+		if pos < next {
+			pos = next
+		}
+		next = pos + 1
+		dist := pos - d
+		if dist > maxDist {
+			maxDist = dist
+		}
+		total += uint64(dist)
+	}
+	return maxDist, float64(total) / float64(len(keys))
+}
+
+// Duplicates returns, in ascending order, the keys which occupy more than one
+// slot. Put never creates duplicates, but maps built by earlier versions
+// which did may contain them. Get and Delete only ever see the first copy of
+// a duplicated key in probe order, so Duplicates scans every slot rather
+// than probing. It is intended as a repair aid and allocates a Go map the
+// size of the table.
+func (m *robinHoodMap) Duplicates() []uint64 {
+	seen := make(map[uint64]int, m.count)
+	var dups []uint64
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			seen[e.key]++
+			if seen[e.key] == 2 {
+				dups = append(dups, e.key)
+			}
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i] < dups[j] })
+	return dups
+}
+
+// checkInvariants verifies the structure of the table, returning an error
+// describing the first violation found. It is intended for use by tests.
+func (m *robinHoodMap) checkInvariants() error {
+	if n := uint32(len(m.entries)); n != m.size+m.maxDist {
+		return fmt.Errorf("expected %d entries, but found %d", m.size+m.maxDist, n)
+	}
+	if e := &m.entries[len(m.entries)-1]; *e != (robinHoodEntry{}) {
+		return fmt.Errorf("sentinel is not empty: [%d,%v,%d]", e.key, e.value, e.dist)
+	}
+
+	var count uint32
+	var prev *robinHoodEntry
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.value == nil {
+			if *e != (robinHoodEntry{}) {
+				return fmt.Errorf("%d: empty entry is not zeroed: [%d,%v,%d]", i, e.key, e.value, e.dist)
+			}
+			prev = e
+			continue
+		}
+		count++
+		desired := m.hash(e.key)
+		if uint32(i) < desired || uint32(i)-desired != e.dist {
+			return fmt.Errorf("%d: key %d desires slot %d, but has dist %d", i, e.key, desired, e.dist)
+		}
+		if e.dist >= m.maxDist {
+			return fmt.Errorf("%d: key %d has dist %d >= max dist %d", i, e.key, e.dist, m.maxDist)
+		}
+		// An entry can be at most one further from its desired slot than its
+		// predecessor. Otherwise, the predecessor is richer and Robin Hood
+		// insertion would have displaced it, or the entry follows an empty slot
+		// which it should have occupied.
+		if e.dist > 0 && (prev == nil || prev.value == nil || e.dist > prev.dist+1) {
+			return fmt.Errorf("%d: key %d at dist %d violates Robin Hood ordering", i, e.key, e.dist)
+		}
+		prev = e
+	}
+	if count != m.count {
+		return fmt.Errorf("expected count %d, but found %d occupied entries", m.count, count)
+	}
+	if m.occupied != nil {
+		if n := (len(m.entries) + 63) / 64; len(m.occupied) != n {
+			return fmt.Errorf("expected %d occupancy words, but found %d", n, len(m.occupied))
+		}
+		for i := range m.entries {
+			set := m.occupied[i/64]&(1<<uint(i%64)) != 0
+			if set != (m.entries[i].value != nil) {
+				return fmt.Errorf("%d: occupancy bit is %t for entry [%d,%v,%d]",
+					i, set, m.entries[i].key, m.entries[i].value, m.entries[i].dist)
+			}
+		}
+	}
+	return nil
+}
+
+// String returns a one-line summary of the map. Use Dump for the contents of
+// every slot.
+func (m *robinHoodMap) String() string {
+	return fmt.Sprintf("count: %d, size: %d, load: %.2f, max dist: %d, avg dist: %.2f",
+		m.count, m.size, m.LoadFactor(), m.MaxDist(), m.AvgDist())
+}
+
+// Dump returns the contents of every slot, including empty slots and the
+// padding at the end of the table, one per line.
+func (m *robinHoodMap) Dump() string {
 	var buf strings.Builder
 	fmt.Fprintf(&buf, "count: %d\n", m.count)
 	for _, v := range m.entries {
@@ -0,0 +1,170 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// hash128 returns the desired slot of a 128-bit key. The high half is mixed
+// before being folded into the low half so that keys which differ in either
+// half, or which swap halves, land in different slots.
+func hash128(k [2]uint64, shift uint32) uint32 {
+	return hash(k[0]^fmix64(k[1]), shift)
+}
+
+type robinHoodEntry128 struct {
+	key   [2]uint64
+	value unsafe.Pointer
+	dist  uint32
+}
+
+// robinHoodMap128 is a variant of robinHoodMap keyed by 128-bit keys such as
+// UUIDs, which can't be truncated to 64 bits without risking collisions. Both
+// halves of the key are hashed and compared. See robinHoodMap for a
+// description of the table layout.
+type robinHoodMap128 struct {
+	entries    []robinHoodEntry128
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+}
+
+func newRobinHoodMap128(initialCapacity int) *robinHoodMap128 {
+	m := &robinHoodMap128{}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMap128) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntry128, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.value != nil {
+			m.Put(e.key, e.value)
+		}
+	}
+}
+
+func (m *robinHoodMap128) entry(i uint32) *robinHoodEntry128 {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntry128)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntry128{})))
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMap128) Put(k [2]uint64, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	n := robinHoodEntry128{key: k, value: v}
+	for i := hash128(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash128(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMap128) Get(k [2]uint64) unsafe.Pointer {
+	var dist uint32
+	for i := hash128(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMap128) Delete(k [2]uint64) {
+	var dist uint32
+	for i := hash128(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntry128{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMap128) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHood128(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap128(0)
+	ref := make(map[[2]uint64]unsafe.Pointer)
+	put := func(k [2]uint64) {
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	check := func() {
+		t.Helper()
+		if m.Len() != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%x: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+
+	// UUID-like keys, plus groups which share the low or the high half with
+	// other keys, and keys whose halves are swapped.
+	for i := 0; i < 1000; i++ {
+		k := [2]uint64{rng.Uint64(), rng.Uint64()}
+		put(k)
+		put([2]uint64{k[0], rng.Uint64()})
+		put([2]uint64{rng.Uint64(), k[1]})
+		put([2]uint64{k[1], k[0]})
+	}
+	for i := uint64(0); i < 100; i++ {
+		put([2]uint64{0, i})
+		put([2]uint64{i, 0})
+	}
+	check()
+
+	// Keys which match a present key in one half only are absent.
+	for k := range ref {
+		for _, miss := range [][2]uint64{{k[0], ^k[1]}, {^k[0], k[1]}} {
+			if _, ok := ref[miss]; ok {
+				continue
+			}
+			if p := m.Get(miss); p != nil {
+				t.Fatalf("%x: expected nil, but found %p", miss, p)
+			}
+			m.Delete(miss)
+		}
+	}
+	check()
+
+	for k := range ref {
+		if rng.Intn(2) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+			if p := m.Get(k); p != nil {
+				t.Fatalf("%x: expected deleted, but found %p", k, p)
+			}
+		}
+	}
+	check()
+}
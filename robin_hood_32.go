@@ -0,0 +1,175 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// hash32 is the 32-bit analog of hash, using the 32-bit Fibonacci constant.
+func hash32(k uint32, shift uint32) uint32 {
+	k |= 1
+	return (k * 2654435769) >> shift
+}
+
+// robinHoodEntry32 packs a 32-bit key and the distance into a single word,
+// shrinking the entry to 16 bytes from the 24 bytes of robinHoodEntry.
+type robinHoodEntry32 struct {
+	key   uint32
+	dist  uint32
+	value unsafe.Pointer
+}
+
+// robinHoodMap32 is a variant of robinHoodMap keyed by uint32. See
+// robinHoodMap for a description of the table layout.
+type robinHoodMap32 struct {
+	entries    []robinHoodEntry32
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+}
+
+func newRobinHoodMap32(initialCapacity int) *robinHoodMap32 {
+	m := &robinHoodMap32{}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMap32) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	// As with hash, a shift of 32 for a size of 1 maps every key to slot 0.
+	m.shift = uint32(32 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntry32, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.value != nil {
+			m.Put(e.key, e.value)
+		}
+	}
+}
+
+func (m *robinHoodMap32) entry(i uint32) *robinHoodEntry32 {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntry32)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntry32{})))
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry. The value must not be nil.
+func (m *robinHoodMap32) Put(k uint32, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap32: nil value")
+	}
+	n := robinHoodEntry32{key: k, value: v, dist: 0}
+	for i := hash32(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash32(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMap32) Get(k uint32) unsafe.Pointer {
+	var dist uint32
+	for i := hash32(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key {
+			// Found.
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMap32) Delete(k uint32) {
+	var dist uint32
+	for i := hash32(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Shift the following entries backwards until the next empty value or
+			// entry with a zero distance. Empty values always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntry32{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMap32) Len() int {
+	return int(m.count)
+}
+
+// MemoryUsage returns the approximate number of bytes used by the map.
+func (m *robinHoodMap32) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*m)) + uint64(cap(m.entries))*uint64(unsafe.Sizeof(robinHoodEntry32{}))
+}
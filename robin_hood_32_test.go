@@ -0,0 +1,112 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHood32(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap32(0)
+	ref := make(map[uint32]unsafe.Pointer)
+	for i := 0; i < 10000; i++ {
+		k := rng.Uint32() % 4096
+		if rng.Intn(3) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		} else {
+			v := unsafe.Pointer(new(int))
+			m.Put(k, v)
+			ref[k] = v
+		}
+	}
+	// The zero key is distinct from an empty slot.
+	m.Put(0, unsafe.Pointer(new(int)))
+	m.Delete(0)
+	m.Delete(0)
+	delete(ref, 0)
+
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k := uint32(0); k < 4096; k++ {
+		if p := m.Get(k); p != ref[k] {
+			t.Fatalf("%d: expected %p, but found %p", k, ref[k], p)
+		}
+	}
+}
+
+func TestRobinHood32OddBitPairs(t *testing.T) {
+	// As with hash, 2n and 2n+1 share a desired slot but are distinct keys.
+	m := newRobinHoodMap32(0)
+	for k := uint32(0); k < 2000; k++ {
+		v := k
+		m.Put(k, unsafe.Pointer(&v))
+	}
+	for k := uint32(0); k < 2000; k += 2 {
+		if hash32(k, m.shift) != hash32(k+1, m.shift) {
+			t.Fatalf("%d: expected %d and %d to share a desired slot", k, k, k+1)
+		}
+		m.Delete(k + 1)
+		if p := m.Get(k + 1); p != nil {
+			t.Fatalf("%d: expected deleted, but found %p", k+1, p)
+		}
+		if p := m.Get(k); p == nil || *(*uint32)(p) != k {
+			t.Fatalf("%d: expected its own value, but found %p", k, p)
+		}
+	}
+	if m.Len() != 1000 {
+		t.Fatalf("expected 1000 entries, but found %d", m.Len())
+	}
+}
+
+func TestRobinHood32SmallSizes(t *testing.T) {
+	for _, size := range []uint32{1, 2} {
+		m := &robinHoodMap32{}
+		m.rehash(size)
+		for k := uint32(0); k < 1000; k++ {
+			if h := hash32(k, m.shift); h >= m.size {
+				t.Fatalf("hash32(%d) = %d, expected < %d", k, h, m.size)
+			}
+		}
+	}
+}
+
+func TestRobinHood32MemoryUsage(t *testing.T) {
+	if s := unsafe.Sizeof(robinHoodEntry32{}); s != 16 {
+		t.Fatalf("expected 16 byte entries, but found %d", s)
+	}
+
+	m32 := newRobinHoodMap32(1000)
+	m64 := newRobinHoodMap(1000)
+	v := unsafe.Pointer(new(int))
+	for k := 0; k < 1000; k++ {
+		m32.Put(uint32(k), v)
+		m64.Put(uint64(k), v)
+	}
+	if m32.size != m64.size {
+		t.Fatalf("expected equal sizes, but found %d and %d", m32.size, m64.size)
+	}
+	if u32, u64 := m32.MemoryUsage(), m64.MemoryUsage(); u32 >= u64 {
+		t.Fatalf("expected 32-bit map to use less than %d bytes, but found %d", u64, u32)
+	} else {
+		t.Logf("32-bit: %d bytes, 64-bit: %d bytes", u32, u64)
+	}
+}
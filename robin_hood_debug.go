@@ -0,0 +1,37 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "sync/atomic"
+
+// beginWrite marks the start of a mutation of the map. When built with the
+// maptoy_debug tag, it panics if another mutation is already in progress,
+// similar to the runtime's detection of concurrent map writes. Otherwise it
+// compiles away to nothing. Every call must be paired with endWrite.
+func (m *robinHoodMap) beginWrite() {
+	if debugChecks {
+		if atomic.AddInt32(&m.writers, 1) != 1 {
+			panic("robinHoodMap: concurrent map writes")
+		}
+	}
+}
+
+// endWrite marks the end of a mutation started by beginWrite.
+func (m *robinHoodMap) endWrite() {
+	if debugChecks {
+		atomic.AddInt32(&m.writers, -1)
+	}
+}
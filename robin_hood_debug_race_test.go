@@ -0,0 +1,67 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+//go:build maptoy_debug && !race
+
+package maptoy
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TestRobinHoodConcurrentWrite performs real concurrent writes, which the race
+// detector would rightly flag, so it is excluded from race builds.
+func TestRobinHoodConcurrentWrite(t *testing.T) {
+	// Size the map so that the writes never grow it.
+	m := newRobinHoodMap(1 << 16)
+	v := unsafe.Pointer(new(int))
+
+	var once sync.Once
+	detected := make(chan struct{})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { close(detected) })
+				}
+			}()
+			for i := uint64(0); ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := uint64(g)<<32 | i%1024
+				m.Put(k, v)
+				m.Delete(k)
+			}
+		}(g)
+	}
+
+	select {
+	case <-detected:
+	case <-time.After(10 * time.Second):
+		t.Errorf("concurrent writes were not detected")
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+//go:build maptoy_debug
+
+package maptoy
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// expectConcurrentWritePanic runs f and verifies that it panics with the
+// concurrent write message.
+func expectConcurrentWritePanic(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.Contains(s, "concurrent map writes") {
+			t.Fatalf("expected concurrent write panic, but found %v", r)
+		}
+	}()
+	f()
+}
+
+func TestRobinHoodConcurrentWriteInjected(t *testing.T) {
+	m := newRobinHoodMap(0)
+	v := unsafe.Pointer(new(int))
+	m.Put(1, v)
+	m.Delete(1)
+
+	// Simulate a mutation in progress on another goroutine.
+	m.writers = 1
+	expectConcurrentWritePanic(t, func() { m.Put(2, v) })
+	m.writers = 1
+	expectConcurrentWritePanic(t, func() { m.PutIfAbsent(2, v) })
+	m.writers = 1
+	expectConcurrentWritePanic(t, func() { m.Delete(2) })
+	m.writers = 1
+	expectConcurrentWritePanic(t, func() { m.LoadAndDelete(2) })
+	m.writers = 1
+	expectConcurrentWritePanic(t, func() { m.CompareAndSwap(2, v, v) })
+}
+
+func TestRobinHoodGetKnownAbsent(t *testing.T) {
+	m := newRobinHoodMap(0)
+	v := unsafe.Pointer(new(int))
+	m.Put(1, v)
+	if p := m.GetKnown(1); p != v {
+		t.Fatalf("expected %p, but found %p", v, p)
+	}
+
+	defer func() {
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.Contains(s, "absent key") {
+			t.Fatalf("expected absent key panic, but found %v", r)
+		}
+	}()
+	m.GetKnown(2)
+}
+
+// expectIterationPanic runs f and verifies that it panics with the mutation
+// during iteration message.
+func expectIterationPanic(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.Contains(s, "mutated during iteration") {
+			t.Fatalf("expected iteration panic, but found %v", r)
+		}
+	}()
+	f()
+}
+
+func TestRobinHoodIteratorGeneration(t *testing.T) {
+	m := newRobinHoodMap(0)
+	for k := uint64(0); k < 100; k++ {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+
+	// Replacing a value does not invalidate the iterator.
+	it := m.Iterator()
+	for i := 0; i < 10 && it.Next(); i++ {
+		m.Put(it.Key(), unsafe.Pointer(new(int)))
+	}
+	var n int
+	for it.Next() {
+		n++
+	}
+	if n != 90 {
+		t.Fatalf("expected 90 more entries, but found %d", n)
+	}
+
+	next := uint64(1000)
+	mutations := []struct {
+		name string
+		f    func()
+	}{
+		{"insert", func() { m.Put(next, unsafe.Pointer(new(int))); next++ }},
+		{"delete", func() { m.Delete(5) }},
+		{"grow", func() { m.Reserve(4 * int(m.size)) }},
+		{"clear", func() { m.Clear() }},
+	}
+	for _, c := range mutations {
+		t.Run(c.name, func(t *testing.T) {
+			m.Put(5, unsafe.Pointer(new(int)))
+			it := m.Iterator()
+			it.Next()
+			c.f()
+			expectIterationPanic(t, func() { it.Next() })
+
+			// RangeFrom detects a mutation between pages but not before the first.
+			m.Put(5, unsafe.Pointer(new(int)))
+			cursor, _ := m.RangeFrom(0, 10, func(uint64, unsafe.Pointer) {})
+			c.f()
+			expectIterationPanic(t, func() { m.RangeFrom(cursor, 10, func(uint64, unsafe.Pointer) {}) })
+			m.RangeFrom(0, 10, func(uint64, unsafe.Pointer) {})
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+type robinHoodEntryFixed[V any] struct {
+	key   uint64
+	dist  uint32
+	used  bool
+	value V
+}
+
+// robinHoodMapFixed is a variant of robinHoodMap which embeds values of type V
+// directly in the entries. It is intended for small fixed-size payloads such
+// as [16]byte or a small struct, where a lookup hit returns the data without
+// chasing a pointer to a second cache line. See robinHoodMap for a
+// description of the table layout.
+type robinHoodMapFixed[V any] struct {
+	entries    []robinHoodEntryFixed[V]
+	entriesPtr unsafe.Pointer
+	entrySize  uintptr
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+}
+
+func newRobinHoodMapFixed[V any](initialCapacity int) *robinHoodMapFixed[V] {
+	m := &robinHoodMapFixed[V]{
+		entrySize: unsafe.Sizeof(robinHoodEntryFixed[V]{}),
+	}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapFixed[V]) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntryFixed[V], size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.used {
+			m.Put(e.key, e.value)
+		}
+	}
+}
+
+func (m *robinHoodMapFixed[V]) entry(i uint32) *robinHoodEntryFixed[V] {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntryFixed[V])(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*m.entrySize))
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapFixed[V]) Put(k uint64, v V) {
+	n := robinHoodEntryFixed[V]{key: k, value: v, dist: 0, used: true}
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if !e.used {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key and whether the key was
+// present.
+func (m *robinHoodMapFixed[V]) Get(k uint64) (V, bool) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.used {
+			// Found.
+			return e.value, true
+		}
+		if dist > e.dist {
+			// Not found.
+			var zero V
+			return zero, false
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapFixed[V]) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.used {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntryFixed[V]{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapFixed[V]) Len() int {
+	return int(m.count)
+}
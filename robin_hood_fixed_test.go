@@ -0,0 +1,114 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodFixed(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapFixed[[16]byte](0)
+	values := make(map[uint64][16]byte)
+	for i := 0; i < 1000; i++ {
+		var v [16]byte
+		rng.Read(v[:])
+		k := uint64(rng.Intn(1 << 20))
+		values[k] = v
+		m.Put(k, v)
+	}
+	// The zero payload is storable.
+	values[1<<20] = [16]byte{}
+	m.Put(1<<20, [16]byte{})
+
+	if m.Len() != len(values) {
+		t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+	}
+	for k, v := range values {
+		if p, ok := m.Get(k); !ok || p != v {
+			t.Fatalf("%d: expected (%x,true), but found (%x,%t)", k, v, p, ok)
+		}
+	}
+
+	for k := range values {
+		if k%2 == 0 {
+			m.Delete(k)
+			delete(values, k)
+		}
+	}
+	for k, v := range values {
+		if p, ok := m.Get(k); !ok || p != v {
+			t.Fatalf("%d: expected (%x,true), but found (%x,%t)", k, v, p, ok)
+		}
+	}
+	if _, ok := m.Get(2 << 20); ok {
+		t.Fatalf("expected missing key")
+	}
+}
+
+func BenchmarkRobinHoodBoxedLookupHit16(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, benchSize)
+	m := newRobinHoodMap(len(keys))
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 20))
+		m.Put(keys[i], unsafe.Pointer(new([16]byte)))
+	}
+	// Look up the keys in a different order than the values were allocated so
+	// that the value accesses are not sequential in memory.
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	b.ResetTimer()
+
+	var v [16]byte
+	for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+		if j == len(keys) {
+			j = 0
+		}
+		v = *(*[16]byte)(m.Get(keys[j]))
+	}
+
+	if testing.Verbose() {
+		fmt.Println(v)
+	}
+}
+
+func BenchmarkRobinHoodFixedLookupHit16(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, benchSize)
+	m := newRobinHoodMapFixed[[16]byte](len(keys))
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 20))
+		m.Put(keys[i], [16]byte{})
+	}
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	b.ResetTimer()
+
+	var v [16]byte
+	for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+		if j == len(keys) {
+			j = 0
+		}
+		v, _ = m.Get(keys[j])
+	}
+
+	if testing.Verbose() {
+		fmt.Println(v)
+	}
+}
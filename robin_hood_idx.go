@@ -0,0 +1,245 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// robinHoodEntryIdx holds the index of a value in the arena of a
+// robinHoodMapIdx rather than a pointer to it.
+type robinHoodEntryIdx struct {
+	key uint64
+	// idx is the index of the value in the arena. Index 0 is never allocated,
+	// so a zero idx marks an empty entry.
+	idx  uint32
+	dist uint32
+}
+
+// robinHoodMapIdx is a variant of robinHoodMap which stores its values in an
+// arena, a slice of V owned by the map, and a uint32 index into the arena in
+// each entry. Inserting a key appends to the arena rather than allocating the
+// value on the heap, and the entries contain no pointers, so the garbage
+// collector does not scan them. Deleting a key zeroes its value and pushes
+// the index on a free list, from which later insertions reuse it, so the
+// arena never holds more values than the peak number of entries. See
+// robinHoodMap for a description of the table layout.
+type robinHoodMapIdx[V any] struct {
+	entries    []robinHoodEntryIdx
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+	// arena holds the values. arena[0] is unused.
+	arena []V
+	// free holds the indexes of arena values released by deletions.
+	free []uint32
+}
+
+func newRobinHoodMapIdx[V any](initialCapacity int) *robinHoodMapIdx[V] {
+	if initialCapacity < 1 {
+		initialCapacity = 1
+	}
+	m := &robinHoodMapIdx[V]{arena: make([]V, 1, initialCapacity+1)}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapIdx[V]) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntryIdx, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.idx != 0 {
+			m.insert(hash(e.key, m.shift), robinHoodEntryIdx{key: e.key, idx: e.idx})
+		}
+	}
+}
+
+func (m *robinHoodMapIdx[V]) entry(i uint32) *robinHoodEntryIdx {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntryIdx)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntryIdx{})))
+}
+
+// alloc stores v in the arena, reusing a freed index if there is one, and
+// returns its index.
+func (m *robinHoodMapIdx[V]) alloc(v V) uint32 {
+	if n := len(m.free); n > 0 {
+		idx := m.free[n-1]
+		m.free = m.free[:n-1]
+		m.arena[idx] = v
+		return idx
+	}
+	m.arena = append(m.arena, v)
+	return uint32(len(m.arena) - 1)
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapIdx[V]) Put(k uint64, v V) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.idx == 0 || e.dist < dist {
+			// The key is not present: an existing entry would have been found
+			// before an empty entry or an entry which is richer than us.
+			m.insert(i, robinHoodEntryIdx{key: k, idx: m.alloc(v), dist: dist})
+			return
+		}
+
+		if e.key == k {
+			// Found an existing entry.
+			m.arena[e.idx] = v
+			return
+		}
+
+		// If we've reached the max distance threshold without finding the key,
+		// grow the table and restart.
+		dist++
+		if dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(k, m.shift) - 1
+			dist = 0
+		}
+	}
+}
+
+// insert inserts n, which is known not to be present, at slot i where n.dist
+// is its distance from its desired slot.
+func (m *robinHoodMapIdx[V]) insert(i uint32, n robinHoodEntryIdx) {
+	for ; ; i++ {
+		e := m.entry(i)
+		if e.idx == 0 {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key and whether the key was
+// present.
+func (m *robinHoodMapIdx[V]) Get(k uint64) (V, bool) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.idx != 0 {
+			// Found.
+			return m.arena[e.idx], true
+		}
+		if dist > e.dist {
+			// Not found.
+			var zero V
+			return zero, false
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present, releasing its
+// value in the arena for reuse.
+func (m *robinHoodMapIdx[V]) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.idx != 0 {
+			// Zero the value so that the arena does not keep anything it refers
+			// to alive.
+			var zero V
+			m.arena[e.idx] = zero
+			m.free = append(m.free, e.idx)
+
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntryIdx{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapIdx[V]) Len() int {
+	return int(m.count)
+}
+
+// CountApprox estimates the number of entries by examining sampleSlots slots
+// spread evenly across the table and scaling their occupancy to the whole
+// table. The samples are fixed rather than random, so the estimate is
+// deterministic and its error depends on how evenly the entries are spread
+// between the sampled slots: clusters of entries or empty slots which fall
+// between samples are missed. If sampleSlots is at least the number of slots,
+// every slot is examined and the count is exact.
+func (m *robinHoodMapIdx[V]) CountApprox(sampleSlots int) int {
+	// The sentinel never holds an entry.
+	slots := uint64(len(m.entries) - 1)
+	if sampleSlots < 1 {
+		sampleSlots = 1
+	}
+	samples := uint64(sampleSlots)
+	if samples > slots {
+		samples = slots
+	}
+	var occupied uint64
+	for i := uint64(0); i < samples; i++ {
+		if m.entries[i*slots/samples].idx != 0 {
+			occupied++
+		}
+	}
+	return int((occupied*slots + samples/2) / samples)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRobinHoodIdx(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapIdx[string](0)
+	ref := make(map[uint64]string)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Intn(2000))
+		if rng.Intn(3) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+			continue
+		}
+		v := string(rune('a' + rng.Intn(26)))
+		ref[k] = v
+		m.Put(k, v)
+	}
+
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p, ok := m.Get(k); !ok || p != v {
+			t.Fatalf("%d: expected (%q,true), but found (%q,%t)", k, v, p, ok)
+		}
+	}
+	for k := uint64(2000); k < 4000; k++ {
+		if p, ok := m.Get(k); ok {
+			t.Fatalf("%d: expected missing, but found %q", k, p)
+		}
+	}
+	// Every allocated index is either live or free.
+	if n := len(m.arena) - 1; n != m.Len()+len(m.free) {
+		t.Fatalf("expected %d arena values, but found %d", m.Len()+len(m.free), n)
+	}
+}
+
+func TestRobinHoodIdxReuse(t *testing.T) {
+	m := newRobinHoodMapIdx[*int](0)
+	for k := uint64(0); k < 100; k++ {
+		v := int(k)
+		m.Put(k, &v)
+	}
+	// The arena grew to hold every value, beyond its initial capacity.
+	if n := len(m.arena); n != 101 {
+		t.Fatalf("expected 101 arena values, but found %d", n)
+	}
+
+	for k := uint64(0); k < 50; k++ {
+		m.Delete(k)
+	}
+	if len(m.free) != 50 {
+		t.Fatalf("expected 50 free indices, but found %d", len(m.free))
+	}
+	for _, idx := range m.free {
+		if m.arena[idx] != nil {
+			t.Fatalf("%d: expected freed value to be zeroed", idx)
+		}
+	}
+
+	// New keys reuse the freed indices rather than growing the arena, and
+	// replacing a value allocates nothing.
+	for k := uint64(100); k < 150; k++ {
+		v := int(k)
+		m.Put(k, &v)
+	}
+	v := -1
+	m.Put(100, &v)
+	if n := len(m.arena); n != 101 {
+		t.Fatalf("expected 101 arena values, but found %d", n)
+	}
+	if len(m.free) != 0 {
+		t.Fatalf("expected no free indices, but found %d", len(m.free))
+	}
+	for k := uint64(50); k < 150; k++ {
+		p, ok := m.Get(k)
+		expected := int(k)
+		if k == 100 {
+			expected = -1
+		}
+		if !ok || *p != expected {
+			t.Fatalf("%d: expected %d, but found %v", k, expected, p)
+		}
+	}
+}
+
+func TestRobinHoodIdxCountApprox(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapIdx[int](0)
+	if n := m.CountApprox(100); n != 0 {
+		t.Fatalf("expected 0, but found %d", n)
+	}
+	for i := 0; i < 100000; i++ {
+		m.Put(uint64(rng.Int63()), i)
+	}
+
+	// Sampling every slot is exact.
+	if n := m.CountApprox(len(m.entries)); n != m.Len() {
+		t.Fatalf("expected %d, but found %d", m.Len(), n)
+	}
+	// Random keys leave the occupancy even across the table, so 4096 evenly
+	// spaced samples land well within 10%.
+	n := m.CountApprox(4096)
+	if d := math.Abs(float64(n-m.Len())) / float64(m.Len()); d > 0.1 {
+		t.Fatalf("expected approximately %d, but found %d", m.Len(), n)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "unsafe"
+
+// incrementalMigrateBudget is the number of entries moved from the old table
+// to the new one by each Put or Delete while a migration is in progress. The
+// new table has at least twice the slots of the old one, so the migration
+// completes long before the new table fills.
+const incrementalMigrateBudget = 8
+
+// robinHoodMapIncremental is a robinHoodMap which avoids the stop-the-world
+// rehash when it grows. When an insertion would require a growth, a new
+// table of the grown size is allocated and the existing table is kept as the
+// old table. Each subsequent Put and Delete then moves a bounded number of
+// entries from the old table into the new one, until the old table is empty
+// and released. During the migration a key lives in exactly one of the two
+// tables, and Get consults both.
+//
+// Get does not migrate entries so that, as with robinHoodMap, concurrent
+// readers are safe as long as there are no writers.
+type robinHoodMapIncremental struct {
+	cur *robinHoodMap
+	// old is the table being migrated from, or nil if no migration is in
+	// progress.
+	old *robinHoodMap
+	// pos is the slot of old before which every entry has been migrated.
+	pos uint32
+}
+
+func newRobinHoodMapIncremental(initialCapacity int) *robinHoodMapIncremental {
+	return &robinHoodMapIncremental{cur: newRobinHoodMap(initialCapacity)}
+}
+
+// migrate moves up to incrementalMigrateBudget entries from the old table to
+// the current one, releasing the old table once it is empty.
+func (m *robinHoodMapIncremental) migrate() {
+	old := m.old
+	for n := 0; n < incrementalMigrateBudget && old.count > 0; {
+		e := old.entry(m.pos)
+		if e.value == nil {
+			m.pos++
+			continue
+		}
+		m.cur.Put(e.key, e.value)
+		// The backward shift may move a later entry into this slot, so pos
+		// is not advanced. Every slot before pos is empty, so neither this
+		// shift nor a Delete of the old table moves an entry before pos.
+		old.removeAt(m.pos)
+		n++
+	}
+	if old.count == 0 {
+		m.old = nil
+		m.pos = 0
+	}
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapIncremental) Put(k uint64, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	if m.old != nil {
+		m.migrate()
+	}
+	if m.old != nil {
+		// The key must only be present in one of the tables.
+		m.old.Delete(k)
+	} else if !m.cur.fits(k) {
+		m.old = m.cur
+		m.cur = newRobinHoodMap(0)
+		m.cur.ResizeTo(int(grownSize(m.old.size, m.old.opts.growth)))
+	}
+	m.cur.Put(k, v)
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapIncremental) Get(k uint64) unsafe.Pointer {
+	if v := m.cur.Get(k); v != nil {
+		return v
+	}
+	if m.old != nil {
+		return m.old.Get(k)
+	}
+	return nil
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapIncremental) Delete(k uint64) {
+	if m.old != nil {
+		m.old.Delete(k)
+		m.migrate()
+	}
+	m.cur.Delete(k)
+}
+
+// Migrating returns true if entries are still being moved from the old table.
+func (m *robinHoodMapIncremental) Migrating() bool {
+	return m.old != nil
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapIncremental) Len() int {
+	n := m.cur.Len()
+	if m.old != nil {
+		n += m.old.Len()
+	}
+	return n
+}
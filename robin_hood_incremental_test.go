@@ -0,0 +1,118 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodIncremental(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapIncremental(0)
+	ref := make(map[uint64]unsafe.Pointer)
+
+	check := func() {
+		t.Helper()
+		if m.Len() != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+
+	var migrations int
+	for i := 0; i < 20000; i++ {
+		k := uint64(rng.Intn(4096))
+		wasMigrating := m.Migrating()
+		if rng.Intn(4) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		} else {
+			ref[k] = unsafe.Pointer(new(int))
+			m.Put(k, ref[k])
+		}
+		if m.Migrating() {
+			if !wasMigrating {
+				migrations++
+			}
+			// Every key lives in exactly one of the tables while migrating.
+			for k := range ref {
+				if (m.cur.Get(k) != nil) == (m.old.Get(k) != nil) {
+					t.Fatalf("%d: expected key in exactly one table", k)
+				}
+			}
+			check()
+		}
+	}
+	if migrations == 0 {
+		t.Fatalf("expected at least one migration")
+	}
+	check()
+}
+
+func TestRobinHoodIncrementalCompletes(t *testing.T) {
+	m := newRobinHoodMapIncremental(0)
+	v := unsafe.Pointer(new(int))
+	var k uint64
+	for !m.Migrating() {
+		m.Put(k, v)
+		k++
+	}
+	n := m.old.Len()
+	// Each operation migrates incrementalMigrateBudget entries, and the
+	// entries in the old table are never more than the new one can hold.
+	for i := 0; m.Migrating(); i++ {
+		if i > n/incrementalMigrateBudget+1 {
+			t.Fatalf("expected migration of %d entries to complete after %d operations",
+				n, n/incrementalMigrateBudget+1)
+		}
+		m.Put(k, v)
+		k++
+	}
+	for i := uint64(0); i < k; i++ {
+		if p := m.Get(i); p != v {
+			t.Fatalf("%d: expected %p, but found %p", i, v, p)
+		}
+	}
+	if err := m.cur.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkRobinHoodIncrementalInsertLatency compares the tail latency of
+// insertions into a growing map with and without incremental rehashing.
+func BenchmarkRobinHoodIncrementalInsertLatency(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 0)
+	v := unsafe.Pointer(new(int))
+	b.Run("rehash", func(b *testing.B) {
+		benchInsertLatency(b, keys, func() func(uint64) {
+			m := newRobinHoodMap(0)
+			return func(k uint64) { m.Put(k, v) }
+		})
+	})
+	b.Run("incremental", func(b *testing.B) {
+		benchInsertLatency(b, keys, func() func(uint64) {
+			m := newRobinHoodMapIncremental(0)
+			return func(k uint64) { m.Put(k, v) }
+		})
+	})
+}
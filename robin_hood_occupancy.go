@@ -0,0 +1,84 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "math/bits"
+
+// The occupancy bitset of a map created with robinHoodOptions.occupancy holds
+// a bit for each slot of the entries, set if the slot holds an entry. Range,
+// Keys and Iterator scan it a word at a time, skipping 64 empty slots per
+// word rather than loading each entry, which speeds up iterating a sparse
+// table. The bitset is shared with snapshots along with the entries, and
+// copied with them by unshare.
+
+// resetOccupancy allocates a cleared bitset for the current entries, if the
+// occupancy option is enabled.
+func (m *robinHoodMap) resetOccupancy() {
+	if m.opts.occupancy {
+		m.occupied = make([]uint64, (len(m.entries)+63)/64)
+	}
+}
+
+// resizeOccupancy resizes the bitset to cover n slots, preserving the bits of
+// the slots below n. The slots at and beyond the current length must be
+// empty. See rehashInPlace.
+func (m *robinHoodMap) resizeOccupancy(n int) {
+	if m.occupied == nil {
+		return
+	}
+	words := (n + 63) / 64
+	if words <= cap(m.occupied) {
+		// The bits of the truncated slots are already clear.
+		m.occupied = m.occupied[:words]
+		return
+	}
+	occupied := make([]uint64, words)
+	copy(occupied, m.occupied)
+	m.occupied = occupied
+}
+
+// setOccupied marks slot i as holding an entry.
+func (m *robinHoodMap) setOccupied(i uint32) {
+	if m.occupied != nil {
+		m.occupied[i/64] |= 1 << (i % 64)
+	}
+}
+
+// clearOccupied marks slot i as empty.
+func (m *robinHoodMap) clearOccupied(i uint32) {
+	if m.occupied != nil {
+		m.occupied[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// nextOccupied returns the first slot at or after i whose bit is set in
+// occupied, or -1 if there is none.
+func nextOccupied(occupied []uint64, i int) int {
+	w := i / 64
+	if w >= len(occupied) {
+		return -1
+	}
+	// Discard the bits of the slots before i in the first word.
+	word := occupied[w] >> uint(i%64) << uint(i%64)
+	for word == 0 {
+		w++
+		if w == len(occupied) {
+			return -1
+		}
+		word = occupied[w]
+	}
+	return w*64 + bits.TrailingZeros64(word)
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+// LoggedOp is an operation recorded in the operation log of a robinHoodMap.
+type LoggedOp struct {
+	Op  OpKind
+	Key uint64
+	// Dist is the distance of the key from its desired slot once an OpPut is
+	// complete, or the distance probed by an OpDelete.
+	Dist uint32
+}
+
+// opLog is a bounded ring buffer of the most recent operations on a map.
+type opLog struct {
+	ops []LoggedOp
+	// next is the index in ops at which the next operation will be recorded.
+	next int
+	// full is set once ops has wrapped around.
+	full bool
+}
+
+func newOpLog(size int) *opLog {
+	return &opLog{ops: make([]LoggedOp, size)}
+}
+
+func (l *opLog) add(op LoggedOp) {
+	l.ops[l.next] = op
+	l.next++
+	if l.next == len(l.ops) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// logOp records an operation on k in the log, if it is enabled.
+func (m *robinHoodMap) logOp(op OpKind, k uint64, dist uint32) {
+	if m.log != nil {
+		m.log.add(LoggedOp{Op: op, Key: k, Dist: dist})
+	}
+}
+
+// logPut is like logOp for an OpPut which may have moved the entry, such as
+// by growing the table, finding the distance of the entry only if the log is
+// enabled.
+func (m *robinHoodMap) logPut(k uint64) {
+	if m.log != nil {
+		m.log.add(LoggedOp{Op: OpPut, Key: k, Dist: m.find(k).dist})
+	}
+}
+
+// OpLog returns the most recently logged operations, oldest first. It returns
+// nil if the log was not enabled at construction. See robinHoodOptions.opLog.
+func (m *robinHoodMap) OpLog() []LoggedOp {
+	l := m.log
+	if l == nil {
+		return nil
+	}
+	if !l.full {
+		return append([]LoggedOp(nil), l.ops[:l.next]...)
+	}
+	ops := make([]LoggedOp, 0, len(l.ops))
+	ops = append(ops, l.ops[l.next:]...)
+	return append(ops, l.ops[:l.next]...)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodOpLog(t *testing.T) {
+	if ops := newRobinHoodMap(0).OpLog(); ops != nil {
+		t.Fatalf("expected no log by default, but found %v", ops)
+	}
+
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{opLog: 4})
+	keys := collidingKeys(3)
+	v := unsafe.Pointer(new(int))
+	check := func(expected ...LoggedOp) {
+		t.Helper()
+		ops := m.OpLog()
+		if len(ops) != len(expected) {
+			t.Fatalf("expected %v, but found %v", expected, ops)
+		}
+		for i := range ops {
+			if ops[i] != expected[i] {
+				t.Fatalf("expected %v, but found %v", expected, ops)
+			}
+		}
+	}
+
+	check()
+	for _, k := range keys {
+		m.Put(k, v)
+	}
+	check(
+		LoggedOp{OpPut, keys[0], 0},
+		LoggedOp{OpPut, keys[1], 1},
+		LoggedOp{OpPut, keys[2], 2},
+	)
+
+	// Deleting keys[1] shifts keys[2] back to dist 1, so reinserting keys[1]
+	// places it at dist 2. The log keeps only the 4 most recent operations.
+	m.Delete(keys[1])
+	m.Put(keys[1], v)
+	m.Put(keys[1], v)
+	check(
+		LoggedOp{OpPut, keys[2], 2},
+		LoggedOp{OpDelete, keys[1], 1},
+		LoggedOp{OpPut, keys[1], 2},
+		LoggedOp{OpPut, keys[1], 2},
+	)
+
+	// Deleting an absent key is logged with the distance probed.
+	m.Delete(keys[1])
+	m.Delete(keys[1])
+	check(
+		LoggedOp{OpPut, keys[1], 2},
+		LoggedOp{OpPut, keys[1], 2},
+		LoggedOp{OpDelete, keys[1], 2},
+		LoggedOp{OpDelete, keys[1], 2},
+	)
+}
+
+func TestRobinHoodOpLogReplay(t *testing.T) {
+	// Replaying a log which has not wrapped around rebuilds the key set,
+	// whichever operations mutated the map.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{opLog: 1 << 20})
+	v := unsafe.Pointer(new(int))
+	ops := []func(k uint64){
+		func(k uint64) { m.Put(k, v) },
+		func(k uint64) { m.PutIfAbsent(k, v) },
+		func(k uint64) { m.PutDist(k, v) },
+		func(k uint64) { *m.PutSlot(k) = v },
+		func(k uint64) { _ = m.TryPut(k, v) },
+		func(k uint64) { m.Swap(k, v) },
+		func(k uint64) { m.GetOrCompute(k, func() unsafe.Pointer { return v }) },
+		func(k uint64) { m.CompareAndSwap(k, v, unsafe.Pointer(new(int))) },
+		func(k uint64) { m.BulkLoad([]uint64{k, k + 1}, []unsafe.Pointer{v, v}) },
+		func(k uint64) { m.Delete(k) },
+		func(k uint64) { m.LoadAndDelete(k) },
+		func(k uint64) { m.DeleteBatch([]uint64{k, k + 1}) },
+		func(k uint64) { m.PopAny() },
+		func(k uint64) {
+			m.RemoveIf(func(key uint64, value unsafe.Pointer) bool { return key%64 == k%64 })
+		},
+		func(k uint64) {
+			m.RangeMutate(func(key uint64, value unsafe.Pointer) (unsafe.Pointer, bool) {
+				return unsafe.Pointer(new(int)), key%64 != k%64
+			})
+		},
+	}
+	for i := 0; i < 5000; i++ {
+		ops[rng.Intn(len(ops))](uint64(rng.Intn(1000)))
+	}
+
+	replayed := make(map[uint64]bool)
+	for _, op := range m.OpLog() {
+		switch op.Op {
+		case OpPut:
+			replayed[op.Key] = true
+		case OpDelete:
+			delete(replayed, op.Key)
+		}
+	}
+	if len(replayed) != m.Len() {
+		t.Fatalf("expected %d keys, but found %d", m.Len(), len(replayed))
+	}
+	for k := range replayed {
+		if m.Get(k) == nil {
+			t.Fatalf("%d: expected present", k)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// maxPackedValue is the largest value a robinHoodMapPacked can store. The
+// high byte of the value word holds the metadata of the entry.
+const maxPackedValue = 1<<56 - 1
+
+const (
+	// packedUsed is set in the value word of occupied entries.
+	packedUsed = 1 << 63
+	// packedDistShift is the position of the distance in the value word.
+	packedDistShift = 56
+	// packedDistMask extracts the distance once shifted down.
+	packedDistMask = 1<<7 - 1
+)
+
+// robinHoodEntryPacked packs the value, distance and occupancy of an entry
+// into a single word: bit 63 is set for occupied entries, bits 56-62 hold the
+// distance and bits 0-55 hold the value. An entry is 16 bytes rather than the
+// 24 of robinHoodEntryU64. The zero word is an empty entry with a distance of
+// 0, as the backward shift of Delete and the early exit of Get require. The
+// max distance threshold is log2 of the table size, at most 32, so every
+// distance fits in the 7 distance bits.
+type robinHoodEntryPacked struct {
+	key  uint64
+	word uint64
+}
+
+func (e *robinHoodEntryPacked) used() bool {
+	return e.word&packedUsed != 0
+}
+
+func (e *robinHoodEntryPacked) dist() uint32 {
+	return uint32(e.word>>packedDistShift) & packedDistMask
+}
+
+func (e *robinHoodEntryPacked) value() uint64 {
+	return e.word & maxPackedValue
+}
+
+// robinHoodMapPacked is a variant of robinHoodMapU64 for value domains which
+// fit in 56 bits, such as offsets into a file or indexes into a slice. The
+// distance and occupancy of each entry are packed into the high byte of the
+// value word, shrinking an entry from 24 to 16 bytes so that 4 entries,
+// rather than 2.67, fit in a 64-byte cache line. Put panics if a value
+// exceeds maxPackedValue. See robinHoodMap for a description of the table
+// layout.
+type robinHoodMapPacked struct {
+	entries    []robinHoodEntryPacked
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+}
+
+func newRobinHoodMapPacked(initialCapacity int) *robinHoodMapPacked {
+	m := &robinHoodMapPacked{}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapPacked) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntryPacked, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.used() {
+			m.Put(e.key, e.value())
+		}
+	}
+}
+
+func (m *robinHoodMapPacked) entry(i uint32) *robinHoodEntryPacked {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntryPacked)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntryPacked{})))
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry. It panics if v exceeds maxPackedValue.
+func (m *robinHoodMapPacked) Put(k uint64, v uint64) {
+	if v > maxPackedValue {
+		panic(fmt.Sprintf("robinHoodMap: value %d exceeds the packed maximum of %d", v, uint64(maxPackedValue)))
+	}
+	n := robinHoodEntryPacked{key: k, word: packedUsed | v}
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if !e.used() {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry. Keep its distance.
+			e.word = e.word&^maxPackedValue | n.value()
+			return
+		}
+
+		if e.dist() < n.dist() {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.word += 1 << packedDistShift
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist() == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.word = packedUsed | n.value()
+		}
+	}
+}
+
+// Get returns the value for the specified key and whether the key was
+// present.
+func (m *robinHoodMapPacked) Get(k uint64) (uint64, bool) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.used() {
+			// Found.
+			return e.value(), true
+		}
+		if dist > e.dist() {
+			// Not found.
+			return 0, false
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapPacked) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.used() {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist() == 0 {
+					*e = robinHoodEntryPacked{}
+					return
+				}
+				*e = *t
+				e.word -= 1 << packedDistShift
+				e = t
+			}
+		}
+		if dist > e.dist() {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapPacked) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodPacked(t *testing.T) {
+	if n := unsafe.Sizeof(robinHoodEntryPacked{}); n != 16 {
+		t.Fatalf("expected 16-byte entries, but found %d", n)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapPacked(0)
+	values := make(map[uint64]uint64)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Intn(1 << 20))
+		// Cover the full range, including both ends.
+		var v uint64
+		switch rng.Intn(4) {
+		case 0:
+		case 1:
+			v = maxPackedValue
+		default:
+			v = uint64(rng.Int63()) & maxPackedValue
+		}
+		values[k] = v
+		m.Put(k, v)
+	}
+	check := func() {
+		t.Helper()
+		if m.Len() != len(values) {
+			t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+		}
+		for k, v := range values {
+			if p, ok := m.Get(k); !ok || p != v {
+				t.Fatalf("%d: expected (%d,true), but found (%d,%t)", k, v, p, ok)
+			}
+		}
+		for i := range m.entries {
+			e := &m.entries[i]
+			if !e.used() {
+				if *e != (robinHoodEntryPacked{}) {
+					t.Fatalf("%d: expected empty entry to be zero, but found %x", i, e.word)
+				}
+				continue
+			}
+			if d := hash(e.key, m.shift); uint32(i)-d != e.dist() {
+				t.Fatalf("%d: key %d desires slot %d, but has dist %d", i, e.key, d, e.dist())
+			}
+			if e.value() != values[e.key] {
+				t.Fatalf("%d: expected value %d, but found %d", i, values[e.key], e.value())
+			}
+		}
+	}
+	check()
+
+	for k := range values {
+		if rng.Intn(2) == 0 {
+			m.Delete(k)
+			delete(values, k)
+		}
+	}
+	check()
+}
+
+func TestRobinHoodPackedDist(t *testing.T) {
+	m := newRobinHoodMapPacked(0)
+	keys := collidingKeys(int(m.maxDist) - 1)
+	for i, k := range keys {
+		m.Put(k, maxPackedValue-uint64(i))
+	}
+	for i, k := range keys {
+		e := &m.entries[i]
+		if e.key != k || e.dist() != uint32(i) || e.value() != maxPackedValue-uint64(i) {
+			t.Fatalf("%d: expected [%d,%d,%d], but found [%d,%d,%d]",
+				i, k, maxPackedValue-uint64(i), i, e.key, e.value(), e.dist())
+		}
+	}
+	// Replacing a value keeps the distance of the entry.
+	last := keys[len(keys)-1]
+	m.Put(last, 0)
+	if e := &m.entries[len(keys)-1]; e.dist() != uint32(len(keys)-1) || e.value() != 0 {
+		t.Fatalf("expected [0,%d], but found [%d,%d]", len(keys)-1, e.value(), e.dist())
+	}
+	// Deleting the head of the chain shifts every entry back by one.
+	m.Delete(keys[0])
+	for i, k := range keys[1:] {
+		if e := &m.entries[i]; e.key != k || e.dist() != uint32(i) {
+			t.Fatalf("%d: expected [%d,%d], but found [%d,%d]", i, k, i, e.key, e.dist())
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "exceeds") {
+			t.Fatalf("expected a value range panic, but found %v", r)
+		}
+	}()
+	m.Put(1, maxPackedValue+1)
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// entryPools holds a *sync.Pool of *[]robinHoodEntry for each length of
+// entries slice, allowing maps created with robinHoodOptions.pool to reuse
+// the backing arrays of released maps and of tables they have outgrown.
+// Pooled slices are always zeroed, so they hold no stale value pointers that
+// would keep their referents alive.
+var entryPools sync.Map
+
+func entryPool(n int) *sync.Pool {
+	if p, ok := entryPools.Load(n); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := entryPools.LoadOrStore(n, &sync.Pool{
+		New: func() interface{} {
+			entries := make([]robinHoodEntry, n)
+			return &entries
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// getEntries returns a zeroed entries slice of length n from the pool.
+func getEntries(n int) []robinHoodEntry {
+	return *entryPool(n).Get().(*[]robinHoodEntry)
+}
+
+// putEntries zeroes entries and returns it to the pool.
+func putEntries(entries []robinHoodEntry) {
+	for i := range entries {
+		entries[i] = robinHoodEntry{}
+	}
+	entryPool(len(entries)).Put(&entries)
+}
+
+// allocEntries returns a zeroed entries slice of length n, taking it from the
+// pool if pooling is enabled, or aligned to a cache line if alignment is
+// enabled.
+func (m *robinHoodMap) allocEntries(n int) []robinHoodEntry {
+	if m.opts.pool {
+		return getEntries(n)
+	}
+	if m.opts.align {
+		return alignedEntries(n)
+	}
+	return make([]robinHoodEntry, n)
+}
+
+// freeEntries returns entries to the pool if pooling is enabled. The caller
+// must ensure that nothing else, such as a snapshot, refers to entries.
+func (m *robinHoodMap) freeEntries(entries []robinHoodEntry) {
+	if m.opts.pool && entries != nil {
+		putEntries(entries)
+	}
+}
+
+// Release returns the entries of a map created with pooling enabled to the
+// pool for reuse by other maps, leaving the map empty. The map must not be
+// used after it is released. If the entries are shared with a snapshot they
+// are left to the garbage collector instead.
+func (m *robinHoodMap) Release() {
+	m.beginWrite()
+	m.evictAll()
+	if !m.shared {
+		m.freeEntries(m.entries)
+	}
+	m.entries = nil
+	m.entriesPtr = unsafe.Pointer(nil)
+	m.occupied = nil
+	m.size, m.count, m.maxDist = 0, 0, 0
+	m.shared = false
+	m.endWrite()
+}
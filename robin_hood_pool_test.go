@@ -0,0 +1,120 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodPool(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	opts := robinHoodOptions{pool: true}
+	for round := 0; round < 10; round++ {
+		m := newRobinHoodMapWithOptions(0, opts)
+		for i := range m.entries {
+			if m.entries[i] != (robinHoodEntry{}) {
+				t.Fatalf("%d: expected zero entry, but found %v", i, m.entries[i])
+			}
+		}
+
+		ref := make(map[uint64]unsafe.Pointer)
+		var s *robinHoodSnapshot
+		var snapshot map[uint64]unsafe.Pointer
+		for i := 0; i < 1000; i++ {
+			k := uint64(rng.Intn(1 << 12))
+			if rng.Intn(4) == 0 {
+				m.Delete(k)
+				delete(ref, k)
+			} else {
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+			}
+			if i == 100 {
+				// Growing after a snapshot must not recycle the snapshot's entries.
+				s = m.Snapshot()
+				snapshot = m.ToGoMap()
+			}
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+		if s.Len() != len(snapshot) {
+			t.Fatalf("expected %d entries in the snapshot, but found %d", len(snapshot), s.Len())
+		}
+		for k, v := range snapshot {
+			if p := s.Get(k); p != v {
+				t.Fatalf("%d: expected %p in the snapshot, but found %p", k, v, p)
+			}
+		}
+		m.Release()
+		if m.entries != nil || m.Len() != 0 {
+			t.Fatalf("expected released map to be empty")
+		}
+	}
+}
+
+func TestRobinHoodPoolZeroed(t *testing.T) {
+	entries := getEntries(10)
+	for i := range entries {
+		entries[i] = robinHoodEntry{uint64(i), unsafe.Pointer(new(int)), 1}
+	}
+	putEntries(entries)
+	// The pool may or may not return the same slice, but either way it is
+	// zeroed.
+	entries = getEntries(10)
+	if len(entries) != 10 {
+		t.Fatalf("expected 10 entries, but found %d", len(entries))
+	}
+	for i := range entries {
+		if entries[i] != (robinHoodEntry{}) {
+			t.Fatalf("%d: expected zero entry, but found %v", i, entries[i])
+		}
+	}
+}
+
+func BenchmarkRobinHoodPool(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, 1000)
+	for i := range keys {
+		keys[i] = uint64(rng.Int63())
+	}
+	v := unsafe.Pointer(new(int))
+
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%t", pool), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := newRobinHoodMapWithOptions(len(keys), robinHoodOptions{pool: pool})
+				for _, k := range keys {
+					m.Put(k, v)
+				}
+				m.Release()
+			}
+		})
+	}
+}
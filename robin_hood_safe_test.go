@@ -0,0 +1,78 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+//go:build maptoy_safe
+
+package maptoy
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestRobinHoodSafeEntry(t *testing.T) {
+	m := newRobinHoodMap(0)
+	func() {
+		defer func() {
+			r := recover()
+			if r == nil || !strings.Contains(r.(error).Error(), "index out of range") {
+				t.Fatalf("expected an index out of range panic, but found %v", r)
+			}
+		}()
+		m.entry(uint32(len(m.entries)))
+	}()
+}
+
+func TestRobinHoodSafeProbeBoundary(t *testing.T) {
+	// Keys hashing to the last slot of the table form a run through the
+	// padding up to the sentinel. A probe loop which walked one slot too far
+	// would index past the end of the entries and panic.
+	m := newRobinHoodMapWithOptions(16, robinHoodOptions{maxDist: func(uint32) uint32 { return 4 }})
+	size := m.size
+	keys := keysWithHash(m.shift, m.size-1, int(m.maxDist))
+	present := keys[:m.maxDist-1]
+	for _, k := range present {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	if m.size != size {
+		t.Fatalf("expected size %d, but found %d", size, m.size)
+	}
+	missing := keys[len(present)]
+	for _, k := range present {
+		if m.Get(k) == nil {
+			t.Fatalf("%d: expected present", k)
+		}
+	}
+	if p := m.Get(missing); p != nil {
+		t.Fatalf("%d: expected nil, but found %p", missing, p)
+	}
+	m.Delete(missing)
+	if _, ok := m.LoadAndDelete(missing); ok {
+		t.Fatalf("%d: expected missing", missing)
+	}
+	if m.Len() != len(present) {
+		t.Fatalf("expected %d entries, but found %d", len(present), m.Len())
+	}
+	for _, k := range present {
+		m.Delete(k)
+	}
+	if m.Len() != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
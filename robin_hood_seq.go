@@ -0,0 +1,216 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+type robinHoodEntrySeq struct {
+	key   uint64
+	value unsafe.Pointer
+	seq   uint64
+	dist  uint32
+}
+
+// robinHoodMapSeq is a variant of robinHoodMap which stamps each entry with a
+// sequence number from a counter which increases with every insertion,
+// recording the relative insertion order of the entries for LRU-style
+// eviction. Whether updating the value of an existing key assigns it a new
+// sequence number is chosen at construction. See robinHoodMap for a
+// description of the table layout.
+type robinHoodMapSeq struct {
+	entries    []robinHoodEntrySeq
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+	// seq is the sequence number of the most recent insertion.
+	seq uint64
+	// refresh selects assigning a new sequence number when the value of an
+	// existing key is updated.
+	refresh bool
+}
+
+func newRobinHoodMapSeq(initialCapacity int, refresh bool) *robinHoodMapSeq {
+	m := &robinHoodMapSeq{refresh: refresh}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapSeq) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntrySeq, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		if e := &oldEntries[i]; e.value != nil {
+			m.insert(robinHoodEntrySeq{key: e.key, value: e.value, seq: e.seq})
+		}
+	}
+}
+
+func (m *robinHoodMapSeq) entry(i uint32) *robinHoodEntrySeq {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntrySeq)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntrySeq{})))
+}
+
+// Put inserts the entry for the specified key with the next sequence number,
+// replacing the value of an existing entry. An existing entry keeps its
+// sequence number unless the map was created with refresh set.
+func (m *robinHoodMapSeq) Put(k uint64, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	m.seq++
+	if !m.insert(robinHoodEntrySeq{key: k, value: v, seq: m.seq}) && !m.refresh {
+		// The sequence number was not used.
+		m.seq--
+	}
+}
+
+// insert inserts n, or replaces the value of an existing entry for its key,
+// returning false in the latter case. The sequence number of an existing
+// entry is replaced only if refresh is set.
+func (m *robinHoodMapSeq) insert(n robinHoodEntrySeq) bool {
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return true
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			if m.refresh {
+				e.seq = n.seq
+			}
+			return false
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// GetWithSeq returns the value and sequence number for the specified key,
+// and whether the key was present.
+func (m *robinHoodMapSeq) GetWithSeq(k uint64) (value unsafe.Pointer, seq uint64, ok bool) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return e.value, e.seq, true
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil, 0, false
+		}
+		dist++
+	}
+}
+
+// GetAndTouch returns the value for the specified key and whether the key was
+// present, stamping a present entry with the sequence number now in the same
+// probe, as an LRU cache does on each access. The counter is advanced to now
+// if it is behind, so that later insertions are still newer than the touched
+// entry. A miss modifies nothing.
+func (m *robinHoodMapSeq) GetAndTouch(k uint64, now uint64) (unsafe.Pointer, bool) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			e.seq = now
+			if now > m.seq {
+				m.seq = now
+			}
+			return e.value, true
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil, false
+		}
+		dist++
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapSeq) Get(k uint64) unsafe.Pointer {
+	v, _, _ := m.GetWithSeq(k)
+	return v
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapSeq) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntrySeq{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapSeq) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodSeq(t *testing.T) {
+	for _, refresh := range []bool{false, true} {
+		t.Run(fmt.Sprintf("refresh=%t", refresh), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			m := newRobinHoodMapSeq(0, refresh)
+			type entry struct {
+				value unsafe.Pointer
+				seq   uint64
+			}
+			ref := make(map[uint64]entry)
+			var seq uint64
+			for i := 0; i < 10000; i++ {
+				k := uint64(rng.Intn(1 << 12))
+				if rng.Intn(4) == 0 {
+					m.Delete(k)
+					delete(ref, k)
+					continue
+				}
+				v := unsafe.Pointer(new(int))
+				m.Put(k, v)
+				if e, ok := ref[k]; ok && !refresh {
+					ref[k] = entry{v, e.seq}
+				} else {
+					// Insertions, and refreshed updates, take the next sequence.
+					seq++
+					ref[k] = entry{v, seq}
+				}
+			}
+
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			seen := make(map[uint64]bool)
+			for k, e := range ref {
+				v, s, ok := m.GetWithSeq(k)
+				if !ok || v != e.value || s != e.seq {
+					t.Fatalf("%d: expected (%p,%d,true), but found (%p,%d,%t)", k, e.value, e.seq, v, s, ok)
+				}
+				if seen[s] {
+					t.Fatalf("%d: duplicate sequence %d", k, s)
+				}
+				seen[s] = true
+			}
+			if _, _, ok := m.GetWithSeq(1 << 12); ok {
+				t.Fatalf("expected absent key")
+			}
+		})
+	}
+}
+
+func TestRobinHoodSeqOrder(t *testing.T) {
+	m := newRobinHoodMapSeq(0, false)
+	v := unsafe.Pointer(new(int))
+	for k := uint64(1); k <= 100; k++ {
+		m.Put(k*7919, v)
+	}
+	// Sequences follow insertion order, across growths of the table.
+	for k := uint64(1); k <= 100; k++ {
+		if _, seq, _ := m.GetWithSeq(k * 7919); seq != k {
+			t.Fatalf("%d: expected sequence %d, but found %d", k*7919, k, seq)
+		}
+	}
+	// Without refresh, an update keeps the sequence and doesn't consume one.
+	m.Put(7919, v)
+	m.Put(101*7919, v)
+	if _, seq, _ := m.GetWithSeq(7919); seq != 1 {
+		t.Fatalf("expected sequence 1, but found %d", seq)
+	}
+	if _, seq, _ := m.GetWithSeq(101 * 7919); seq != 101 {
+		t.Fatalf("expected sequence 101, but found %d", seq)
+	}
+
+	r := newRobinHoodMapSeq(0, true)
+	r.Put(1, v)
+	r.Put(2, v)
+	r.Put(1, v)
+	if _, seq, _ := r.GetWithSeq(1); seq != 3 {
+		t.Fatalf("expected refreshed sequence 3, but found %d", seq)
+	}
+}
+
+func TestRobinHoodSeqGetAndTouch(t *testing.T) {
+	m := newRobinHoodMapSeq(0, false)
+	values := make([]unsafe.Pointer, 100)
+	for k := range values {
+		values[k] = unsafe.Pointer(new(int))
+		m.Put(uint64(k), values[k])
+	}
+
+	// Each touch advances the sequence of the entry.
+	for now := uint64(1000); now < 1010; now++ {
+		if v, ok := m.GetAndTouch(7, now); !ok || v != values[7] {
+			t.Fatalf("expected (%p,true), but found (%p,%t)", values[7], v, ok)
+		}
+		if _, seq, _ := m.GetWithSeq(7); seq != now {
+			t.Fatalf("expected sequence %d, but found %d", now, seq)
+		}
+	}
+	// Touching one entry leaves the others alone.
+	for k := range values {
+		if _, seq, _ := m.GetWithSeq(uint64(k)); k != 7 && seq != uint64(k+1) {
+			t.Fatalf("%d: expected sequence %d, but found %d", k, k+1, seq)
+		}
+	}
+	// Later insertions are newer than the touched entry.
+	m.Put(100, values[0])
+	if _, seq, _ := m.GetWithSeq(100); seq != 1010 {
+		t.Fatalf("expected sequence 1010, but found %d", seq)
+	}
+
+	// A miss touches nothing.
+	before := append([]robinHoodEntrySeq(nil), m.entries...)
+	counter := m.seq
+	if v, ok := m.GetAndTouch(1000, 5000); ok || v != nil {
+		t.Fatalf("expected (nil,false), but found (%p,%t)", v, ok)
+	}
+	if m.seq != counter {
+		t.Fatalf("expected counter %d, but found %d", counter, m.seq)
+	}
+	for i := range before {
+		if before[i] != m.entries[i] {
+			t.Fatalf("%d: expected entry to be unchanged", i)
+		}
+	}
+}
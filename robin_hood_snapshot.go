@@ -0,0 +1,64 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "unsafe"
+
+// robinHoodSnapshot is a read-only, point-in-time view of a robinHoodMap. A
+// snapshot shares the entries of the map it was taken from. The map copies
+// its entries on the first mutation after a snapshot is taken, leaving the
+// snapshot with the frozen original. Taking a snapshot is therefore O(1),
+// while the first subsequent write is O(size).
+type robinHoodSnapshot struct {
+	m robinHoodMap
+}
+
+// Snapshot returns a read-only view of the current contents of the map which
+// is unaffected by subsequent mutations of the map.
+func (m *robinHoodMap) Snapshot() *robinHoodSnapshot {
+	m.shared = true
+	return &robinHoodSnapshot{m: *m}
+}
+
+// unshare copies the entries of a map whose entries are shared with one or
+// more snapshots.
+func (m *robinHoodMap) unshare() {
+	entries := m.allocEntries(len(m.entries))
+	copy(entries, m.entries)
+	m.entries = entries
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	if m.occupied != nil {
+		m.occupied = append([]uint64(nil), m.occupied...)
+	}
+	m.shared = false
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (s *robinHoodSnapshot) Get(k uint64) unsafe.Pointer {
+	return s.m.Get(k)
+}
+
+// Len returns the number of entries in the snapshot.
+func (s *robinHoodSnapshot) Len() int {
+	return s.m.Len()
+}
+
+// Range calls f for each entry in the snapshot. The order of iteration is
+// unspecified. If f returns false, iteration stops.
+func (s *robinHoodSnapshot) Range(f func(key uint64, value unsafe.Pointer) bool) {
+	s.m.Range(f)
+}
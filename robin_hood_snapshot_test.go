@@ -0,0 +1,101 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// checkSnapshot verifies that the snapshot contains exactly the expected
+// entries.
+func checkSnapshot(t *testing.T, s *robinHoodSnapshot, expected map[uint64]unsafe.Pointer) {
+	t.Helper()
+	if s.Len() != len(expected) {
+		t.Fatalf("expected %d entries, but found %d", len(expected), s.Len())
+	}
+	for k, v := range expected {
+		if p := s.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	var n int
+	s.Range(func(k uint64, v unsafe.Pointer) bool {
+		if expected[k] != v {
+			t.Fatalf("%d: unexpected value %p", k, v)
+		}
+		n++
+		return true
+	})
+	if n != len(expected) {
+		t.Fatalf("expected %d entries, but found %d", len(expected), n)
+	}
+}
+
+func TestRobinHoodSnapshot(t *testing.T) {
+	m := newRobinHoodMap(0)
+	current := make(map[uint64]unsafe.Pointer)
+	for i := uint64(1); i <= 100; i++ {
+		current[i] = unsafe.Pointer(new(int))
+		m.Put(i, current[i])
+	}
+	clone := func() map[uint64]unsafe.Pointer {
+		c := make(map[uint64]unsafe.Pointer, len(current))
+		for k, v := range current {
+			c[k] = v
+		}
+		return c
+	}
+
+	s1, expected1 := m.Snapshot(), clone()
+	checkSnapshot(t, s1, expected1)
+
+	// Overwrite, delete and insert after the first snapshot.
+	current[1] = unsafe.Pointer(new(int))
+	m.Put(1, current[1])
+	delete(current, 2)
+	m.Delete(2)
+	current[1000] = unsafe.Pointer(new(int))
+	m.Put(1000, current[1000])
+	checkSnapshot(t, s1, expected1)
+
+	s2, expected2 := m.Snapshot(), clone()
+	s3 := m.Snapshot()
+	for i := uint64(2000); i < 3000; i++ {
+		current[i] = unsafe.Pointer(new(int))
+		m.Put(i, current[i])
+	}
+	if _, ok := m.LoadAndDelete(3); !ok {
+		t.Fatalf("expected key 3 to be present")
+	}
+	delete(current, 3)
+	if !m.CompareAndSwap(4, current[4], current[1]) {
+		t.Fatalf("expected swap to succeed")
+	}
+	current[4] = current[1]
+
+	checkSnapshot(t, s1, expected1)
+	checkSnapshot(t, s2, expected2)
+	checkSnapshot(t, s3, expected2)
+	for k, v := range current {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	if m.Len() != len(current) {
+		t.Fatalf("expected %d entries, but found %d", len(current), m.Len())
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// robinHoodMapStash is a variant of robinHoodMap which, rather than growing
+// the table as soon as an insertion reaches the max distance threshold, first
+// places the entry being carried in a small secondary "stash" of up to
+// stashSize entries. The table only grows when the stash is also full, so a
+// few unlucky keys don't force a rehash of the whole table. A growth moves
+// the stash back into the table.
+//
+// The stash is probed linearly after a miss in the table, and only when it is
+// non-empty, so lookups of keys in the table and misses against an empty
+// stash are unaffected, while misses against a non-empty stash pay for the
+// scan. See robinHoodMap for a description of the table layout.
+//
+// The stash stands in for a secondary probe with a different stride, which
+// does not work with Robin Hood ordering. A lookup stops at the first entry
+// closer to its desired slot than the probe, and a deletion shifts the
+// following run back by one slot, both assuming that every entry lies in the
+// contiguous run after its desired slot at its recorded distance. An entry
+// placed by a second stride lies outside any such run: lookups would stop
+// before reaching it, and backward shifts would move it away from the slot
+// its stride computes, or move other entries over it. Keeping the overflow
+// out of the table proper preserves the invariants instead.
+//
+// The stash helps when a few colliding keys would otherwise grow a lightly
+// loaded table. For random keys it does not reduce the number of rehashes:
+// once the load is high enough for one insertion to reach the threshold,
+// the next few do too and the stash fills quickly. See
+// BenchmarkRobinHoodStash.
+type robinHoodMapStash struct {
+	entries    []robinHoodEntry
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+	stash      []robinHoodEntry
+	// rehashes counts the growths of the table.
+	rehashes int
+}
+
+func newRobinHoodMapStash(initialCapacity, stashSize int) *robinHoodMapStash {
+	m := &robinHoodMapStash{stash: make([]robinHoodEntry, 0, stashSize)}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapStash) rehash(size uint32) {
+	oldEntries := m.entries
+	oldStash := append([]robinHoodEntry(nil), m.stash...)
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntry, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.stash = m.stash[:0]
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.value != nil {
+			m.insert(robinHoodEntry{key: e.key, value: e.value})
+		}
+	}
+	for i := range oldStash {
+		m.insert(robinHoodEntry{key: oldStash[i].key, value: oldStash[i].value})
+	}
+}
+
+func (m *robinHoodMapStash) entry(i uint32) *robinHoodEntry {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntry)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntry{})))
+}
+
+// stashIndex returns the index of the specified key in the stash, or -1.
+func (m *robinHoodMapStash) stashIndex(k uint64) int {
+	for i := range m.stash {
+		if m.stash[i].key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapStash) Put(k uint64, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	if len(m.stash) > 0 {
+		if i := m.stashIndex(k); i >= 0 {
+			m.stash[i].value = v
+			return
+		}
+	}
+	m.insert(robinHoodEntry{key: k, value: v})
+}
+
+// insert inserts n, which is not present in the stash, into the table.
+func (m *robinHoodMapStash) insert(n robinHoodEntry) {
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, stash the entry we're
+		// carrying. If the stash is full, grow the table and restart the
+		// insertion of the entry.
+		if n.dist == m.maxDist {
+			if len(m.stash) < cap(m.stash) {
+				n.dist = 0
+				m.stash = append(m.stash, n)
+				m.count++
+				return
+			}
+			m.rehashes++
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapStash) Get(k uint64) unsafe.Pointer {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found.
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found in the table.
+			if len(m.stash) > 0 {
+				if i := m.stashIndex(k); i >= 0 {
+					return m.stash[i].value
+				}
+			}
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapStash) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntry{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found in the table.
+			if len(m.stash) > 0 {
+				if i := m.stashIndex(k); i >= 0 {
+					last := len(m.stash) - 1
+					m.stash[i] = m.stash[last]
+					m.stash[last] = robinHoodEntry{}
+					m.stash = m.stash[:last]
+					m.count--
+				}
+			}
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map, including stashed entries.
+func (m *robinHoodMapStash) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodStash(t *testing.T) {
+	// Colliding keys overflow the table at every size, exercising the stash
+	// insert and lookup paths.
+	m := newRobinHoodMapStash(0, 2)
+	keys := collidingKeys(int(m.maxDist) + 2)
+	values := make(map[uint64]unsafe.Pointer)
+	for _, k := range keys {
+		values[k] = unsafe.Pointer(new(int))
+		m.Put(k, values[k])
+	}
+	if m.rehashes != 0 {
+		t.Fatalf("expected no rehashes, but found %d", m.rehashes)
+	}
+	if len(m.stash) != 2 {
+		t.Fatalf("expected 2 stashed entries, but found %d", len(m.stash))
+	}
+	check := func() {
+		t.Helper()
+		if m.Len() != len(values) {
+			t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+		}
+		for k, v := range values {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+	check()
+
+	// Updating a stashed key replaces its value in place.
+	stashed := m.stash[0].key
+	values[stashed] = unsafe.Pointer(new(int))
+	m.Put(stashed, values[stashed])
+	if len(m.stash) != 2 || m.Len() != len(values) {
+		t.Fatalf("expected the stashed key to be updated in place")
+	}
+	check()
+
+	// Deleting a stashed key and a key in the table.
+	for _, k := range []uint64{stashed, keys[0]} {
+		m.Delete(k)
+		delete(values, k)
+		if p := m.Get(k); p != nil {
+			t.Fatalf("%d: expected deleted, but found %p", k, p)
+		}
+	}
+	check()
+
+	// Overflowing the full stash grows the table and empties the stash into it.
+	more := collidingKeys(len(keys) + 3)[len(keys):]
+	for _, k := range more {
+		values[k] = unsafe.Pointer(new(int))
+		m.Put(k, values[k])
+	}
+	if m.rehashes == 0 {
+		t.Fatalf("expected a rehash")
+	}
+	check()
+}
+
+func TestRobinHoodStashRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapStash(0, 4)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 100000; i++ {
+		k := uint64(rng.Intn(1 << 14))
+		if rng.Intn(3) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+			continue
+		}
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	for k := uint64(1 << 14); k < 1<<15; k++ {
+		if p := m.Get(k); p != nil {
+			t.Fatalf("%d: expected nil, but found %p", k, p)
+		}
+	}
+}
+
+func BenchmarkRobinHoodStash(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, benchSize)
+	for i := range keys {
+		keys[i] = uint64(rng.Int63())
+	}
+	v := unsafe.Pointer(new(int))
+
+	for _, stashSize := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("insert/stash=%d", stashSize), func(b *testing.B) {
+			var rehashes, size int
+			for i := 0; i < b.N; i++ {
+				m := newRobinHoodMapStash(0, stashSize)
+				for _, k := range keys {
+					m.Put(k, v)
+				}
+				rehashes += m.rehashes
+				size = int(m.size)
+			}
+			b.ReportMetric(float64(rehashes)/float64(b.N), "rehashes/op")
+			b.ReportMetric(float64(size), "size")
+		})
+
+		m := newRobinHoodMapStash(0, stashSize)
+		for _, k := range keys {
+			m.Put(k, v)
+		}
+		b.Run(fmt.Sprintf("lookup-hit/stash=%d", stashSize), func(b *testing.B) {
+			var p unsafe.Pointer
+			for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+				if j == len(keys) {
+					j = 0
+				}
+				p = m.Get(keys[j])
+			}
+			if testing.Verbose() {
+				fmt.Println(p)
+			}
+		})
+		b.Run(fmt.Sprintf("lookup-miss/stash=%d", stashSize), func(b *testing.B) {
+			var p unsafe.Pointer
+			for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+				if j == len(keys) {
+					j = 0
+				}
+				p = m.Get(^keys[j])
+			}
+			if testing.Verbose() {
+				fmt.Println(p)
+			}
+		})
+	}
+}
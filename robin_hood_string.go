@@ -0,0 +1,206 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+type robinHoodEntryString struct {
+	key   string
+	value unsafe.Pointer
+	// hash is the full 64-bit stringHash of key. It is only relied upon if
+	// the map stores hashes.
+	hash uint64
+	dist uint32
+}
+
+// robinHoodMapString is a variant of robinHoodMap keyed by strings. Hashing
+// a string is far more expensive than hashing a uint64, so the map can
+// optionally store the full hash of each key in its entry. A stored hash is
+// used in place of rehashing the key when the table grows, and is compared
+// before the keys in the probe loop, so that a key comparison is only made
+// for an entry which almost certainly matches. See robinHoodMap for a
+// description of the table layout.
+type robinHoodMapString struct {
+	entries    []robinHoodEntryString
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+	storeHash  bool
+}
+
+// newRobinHoodMapString returns a map with room for initialCapacity entries,
+// storing the hash of each key in its entry if storeHash is set.
+func newRobinHoodMapString(initialCapacity int, storeHash bool) *robinHoodMapString {
+	m := &robinHoodMapString{storeHash: storeHash}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+// stringHash returns the 64-bit FNV-1a hash of s.
+func stringHash(s string) uint64 {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	h := uint64(offset)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime
+	}
+	return h
+}
+
+func (m *robinHoodMapString) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntryString, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.value != nil {
+			h := e.hash
+			if !m.storeHash {
+				h = stringHash(e.key)
+			}
+			m.put(e.key, e.value, h)
+		}
+	}
+}
+
+func (m *robinHoodMapString) entry(i uint32) *robinHoodEntryString {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntryString)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntryString{})))
+}
+
+// matches returns true if e is occupied by the key k with hash h. When hashes
+// are stored, a mismatched hash rules out the entry without comparing keys.
+func (m *robinHoodMapString) matches(e *robinHoodEntryString, k string, h uint64) bool {
+	return e.value != nil && (!m.storeHash || e.hash == h) && e.key == k
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapString) Put(k string, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	m.put(k, v, stringHash(k))
+}
+
+func (m *robinHoodMapString) put(k string, v unsafe.Pointer, h uint64) {
+	n := robinHoodEntryString{key: k, value: v, hash: h, dist: 0}
+	for i := hash(n.hash, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if m.matches(e, n.key, n.hash) {
+			// Found an existing entry.
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying. Without stored hashes the
+		// carried entry's hash is recomputed, as it may have been swapped in.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			if !m.storeHash {
+				n.hash = stringHash(n.key)
+			}
+			i = hash(n.hash, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapString) Get(k string) unsafe.Pointer {
+	h := stringHash(k)
+	var dist uint32
+	for i := hash(h, m.shift); ; i++ {
+		e := m.entry(i)
+		if m.matches(e, k, h) {
+			// Found.
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapString) Delete(k string) {
+	h := stringHash(k)
+	var dist uint32
+	for i := hash(h, m.shift); ; i++ {
+		e := m.entry(i)
+		if m.matches(e, k, h) {
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			m.count--
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntryString{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapString) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodStringKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, storeHash := range []bool{false, true} {
+		t.Run(fmt.Sprintf("storeHash=%t", storeHash), func(t *testing.T) {
+			m := newRobinHoodMapString(0, storeHash)
+			ref := make(map[string]unsafe.Pointer)
+			// Long keys sharing a prefix compare equal up to their last bytes.
+			prefix := strings.Repeat("x", 32)
+			for i := 0; i < 20000; i++ {
+				k := fmt.Sprintf("%s%d", prefix, rng.Intn(8192))
+				if rng.Intn(4) == 0 {
+					m.Delete(k)
+					delete(ref, k)
+					continue
+				}
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+			}
+
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%s: expected %p, but found %p", k, v, p)
+				}
+			}
+			for i := 8192; i < 16384; i++ {
+				k := fmt.Sprintf("%s%d", prefix, i)
+				if p := m.Get(k); p != nil {
+					t.Fatalf("%s: expected nil, but found %p", k, p)
+				}
+			}
+			if storeHash {
+				for i := range m.entries {
+					if e := &m.entries[i]; e.value != nil && e.hash != stringHash(e.key) {
+						t.Fatalf("%s: expected hash %d, but found %d", e.key, stringHash(e.key), e.hash)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRobinHoodStringRehash measures rehashing a table of long string
+// keys in place, with and without stored hashes.
+func BenchmarkRobinHoodStringRehash(b *testing.B) {
+	const n = 1 << 16
+	rng := rand.New(rand.NewSource(benchSeed(b)))
+	prefix := strings.Repeat("x", 64)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%d", prefix, rng.Int63())
+	}
+	v := unsafe.Pointer(new(int))
+
+	for _, storeHash := range []bool{false, true} {
+		b.Run(fmt.Sprintf("storeHash=%t", storeHash), func(b *testing.B) {
+			m := newRobinHoodMapString(n, storeHash)
+			for _, k := range keys {
+				m.Put(k, v)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.rehash(m.size)
+			}
+		})
+	}
+}
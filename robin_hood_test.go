@@ -16,8 +16,15 @@
 package maptoy
 
 import (
+	"flag"
 	"fmt"
+	"math"
+	"math/bits"
 	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -25,34 +32,3784 @@ import (
 
 const benchSize = 1 << 20
 
+// benchSeedFlag fixes the seed of the benchmark key sets. Benchmark results
+// depend on the key set, in particular on the max and average distances it
+// produces, so to compare two implementations fairly run both with the same
+// seed, e.g.:
+//
+//	go test -run - -bench Lookup -count 10 -maptoy.seed 1 > old.txt
+//	go test -run - -bench Lookup -count 10 -maptoy.seed 1 > new.txt
+//	benchstat old.txt new.txt
+//
+// The default of 0 selects a new seed for every benchmark, which samples the
+// variation between key sets instead.
+var benchSeedFlag = flag.Int64("maptoy.seed", 0, "seed for the benchmark key sets (0 selects a time-based seed)")
+
+// benchSeed returns the seed for the key set of a benchmark, logging it in
+// verbose mode so that the run can be reproduced with -maptoy.seed.
+func benchSeed(b *testing.B) int64 {
+	seed := *benchSeedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if testing.Verbose() {
+		b.Logf("seed: %d", seed)
+	}
+	return seed
+}
+
+// benchKeys returns n keys generated from the specified seed. The keys are
+// in [0,bound) if bound is positive, and non-negative int63s otherwise. The
+// same seed always produces the same keys.
+func benchKeys(seed int64, n int, bound int) []uint64 {
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]uint64, n)
+	for i := range keys {
+		if bound > 0 {
+			keys[i] = uint64(rng.Intn(bound))
+		} else {
+			keys[i] = uint64(rng.Int63())
+		}
+	}
+	return keys
+}
+
+// benchRobinHoodMap returns a map with the specified initial capacity
+// holding keys, all with the same value.
+func benchRobinHoodMap(capacity int, keys []uint64) *robinHoodMap {
+	m := newRobinHoodMap(capacity)
+	v := unsafe.Pointer(new(int))
+	for _, k := range keys {
+		m.Put(k, v)
+	}
+	return m
+}
+
+// benchGoMap is benchRobinHoodMap for a Go map, with nil values.
+func benchGoMap(keys []uint64) map[uint64]unsafe.Pointer {
+	m := make(map[uint64]unsafe.Pointer, len(keys))
+	for _, k := range keys {
+		m[k] = nil
+	}
+	return m
+}
+
+// benchMissKeys returns keys shifted out of the [0,bound) range of the keys
+// of a map built from benchKeys, so that every lookup misses.
+func benchMissKeys(keys []uint64, bound int) []uint64 {
+	miss := make([]uint64, len(keys))
+	for i, k := range keys {
+		miss[i] = k + uint64(bound)
+	}
+	return miss
+}
+
+// benchInsertLatency inserts keys into each map returned by newPut, timing
+// every insertion individually, and reports the mean p99 and maximum
+// latencies of an iteration. These are dominated by the pauses to grow the
+// map rather than by the typical insertion.
+func benchInsertLatency(b *testing.B, keys []uint64, newPut func() func(k uint64)) {
+	latencies := make([]time.Duration, len(keys))
+	var p99, max time.Duration
+	for i := 0; i < b.N; i++ {
+		put := newPut()
+		for j, k := range keys {
+			start := time.Now()
+			put(k)
+			latencies[j] = time.Since(start)
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 += latencies[len(latencies)*99/100]
+		max += latencies[len(latencies)-1]
+	}
+	b.ReportMetric(float64(p99.Nanoseconds())/float64(b.N), "p99-ns")
+	b.ReportMetric(float64(max.Nanoseconds())/float64(b.N), "max-ns")
+}
+
+// collidingKeys returns n keys which hash to slot 0 for every table size.
+// Multiplying by the Fibonacci hash constant is invertible modulo 2^64, so
+// the keys are chosen to be the inverse of small odd products.
+func collidingKeys(n int) []uint64 {
+	inv := fibonacciInverse()
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = inv * uint64(2*i+1)
+	}
+	return keys
+}
+
+// fibonacciInverse returns the inverse of the Fibonacci hash constant modulo
+// 2^64, so that the odd key inv*p hashes to the high bits of p.
+func fibonacciInverse() uint64 {
+	const c = 11400714819323198485
+	// Newton's method doubles the number of correct low bits each iteration.
+	inv := uint64(c)
+	for i := 0; i < 5; i++ {
+		inv *= 2 - c*inv
+	}
+	return inv
+}
+
+// clusteredKeys returns n keys for each of the specified number of random
+// clusters. The keys of a cluster share the high 32 bits of their hashes, so
+// they have the same desired slot for every table size up to 2^32.
+func clusteredKeys(rng *rand.Rand, clusters, n int) []uint64 {
+	inv := fibonacciInverse()
+	keys := make([]uint64, 0, clusters*n)
+	for i := 0; i < clusters; i++ {
+		high := rng.Uint64() &^ (1<<32 - 1)
+		for j := 0; j < n; j++ {
+			keys = append(keys, inv*(high|uint64(2*j+1)))
+		}
+	}
+	return keys
+}
+
+// keysWithHash returns n keys which all hash to slot h for the specified
+// shift. It is used to construct collision chains.
+func keysWithHash(shift, h uint32, n int) []uint64 {
+	keys := make([]uint64, 0, n)
+	for k := uint64(1); len(keys) < n; k++ {
+		if hash(k, shift) == h {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 func TestRobinHood(t *testing.T) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, 4)
+	keys := make([]uint64, 4)
+	m := newRobinHoodMap(0)
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 20))
+		v := new(int)
+		*v = i
+		m.Put(keys[i], unsafe.Pointer(v))
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fmt.Printf("%s\n", m.Dump())
+	for i := range keys {
+		fmt.Println(m.Get(keys[i]))
+	}
+
+	for i := range keys {
+		m.Delete(keys[i])
+		fmt.Printf("%s\n", m.Dump())
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobinHoodString(t *testing.T) {
+	m := newRobinHoodMap(0)
+	keys := collidingKeys(3)
+	for _, k := range keys {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+
+	expected := fmt.Sprintf("count: 3, size: %d, load: %.2f, max dist: 2, avg dist: 1.00",
+		m.size, float64(3)/float64(m.size))
+	if s := m.String(); s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+	if s := fmt.Sprintf("%s", m); s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+
+	dump := m.Dump()
+	if lines := strings.Count(dump, "\n"); lines != len(m.entries)+1 {
+		t.Fatalf("expected %d lines, but found %d", len(m.entries)+1, lines)
+	}
+	for i, k := range keys {
+		slot := fmt.Sprintf("[%d,%v,%d]\n", k, m.Get(k), i)
+		if !strings.Contains(dump, slot) {
+			t.Fatalf("expected %q in dump:\n%s", slot, dump)
+		}
+	}
+}
+
+func TestRobinHoodInvariants(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Intn(2000))
+		if rng.Intn(3) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		} else {
+			v := unsafe.Pointer(new(int))
+			m.Put(k, v)
+			ref[k] = v
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodIterator(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	it := m.Iterator()
+	if it.Next() {
+		t.Fatalf("expected empty iteration, found key %d", it.Key())
+	}
+
+	values := make(map[uint64]unsafe.Pointer)
+	for _, k := range rng.Perm(1000) {
+		v := unsafe.Pointer(new(int))
+		values[uint64(k)] = v
+		m.Put(uint64(k), v)
+	}
+
+	keys := m.Keys()
+	var n int
+	for it := m.Iterator(); it.Next(); n++ {
+		if n >= len(keys) {
+			t.Fatalf("iterator returned more than %d entries", len(keys))
+		}
+		if keys[n] != it.Key() {
+			t.Fatalf("%d: expected key %d, but found %d", n, keys[n], it.Key())
+		}
+		if values[it.Key()] != it.Value() {
+			t.Fatalf("%d: unexpected value for key %d", n, it.Key())
+		}
+	}
+	if n != len(keys) {
+		t.Fatalf("expected %d entries, but found %d", len(keys), n)
+	}
+}
+
+func TestRobinHoodOccupancy(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{occupancy: true, adaptiveMaxDist: true})
+	ref := make(map[uint64]unsafe.Pointer)
+	check := func() {
+		t.Helper()
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		m.Range(func(k uint64, v unsafe.Pointer) bool {
+			if ref[k] != v {
+				t.Fatalf("%d: expected %p, but found %p", k, ref[k], v)
+			}
+			n++
+			return true
+		})
+		if n != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), n)
+		}
+		keys := m.Keys()
+		n = 0
+		for it := m.Iterator(); it.Next(); n++ {
+			if keys[n] != it.Key() || ref[it.Key()] != it.Value() {
+				t.Fatalf("%d: expected key %d, but found %d", n, keys[n], it.Key())
+			}
+		}
+		if n != len(ref) || len(keys) != len(ref) {
+			t.Fatalf("expected %d entries, but found %d keys and %d iterated", len(ref), len(keys), n)
+		}
+	}
+
+	for i := 0; i < 20000; i++ {
+		k := uint64(rng.Intn(5000))
+		if rng.Intn(2) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		} else {
+			ref[k] = unsafe.Pointer(new(int))
+			m.Put(k, ref[k])
+		}
+	}
+	// A cluster forces the adaptive policy to widen maxDist in place.
+	for _, k := range collidingKeys(20) {
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	check()
+
+	// A snapshot keeps its own view of the occupied slots.
+	s := m.Snapshot()
+	snapLen := s.Len()
+	for k := range ref {
+		m.Delete(k)
+		delete(ref, k)
+		if len(ref) < snapLen/2 {
+			break
+		}
+	}
+	check()
+	var n int
+	s.Range(func(k uint64, v unsafe.Pointer) bool {
+		n++
+		return true
+	})
+	if n != snapLen {
+		t.Fatalf("expected %d snapshot entries, but found %d", snapLen, n)
+	}
+
+	m.Clear()
+	ref = make(map[uint64]unsafe.Pointer)
+	check()
+	ref[7] = unsafe.Pointer(new(int))
+	m.Put(7, ref[7])
+	check()
+}
+
+func TestRobinHoodOddBitPairs(t *testing.T) {
+	// hash sets the low bit of its copy of the key, so 2n and 2n+1 share a
+	// desired slot. The stored key, and the comparison against it, is the
+	// full key.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	evens := []uint64{0, 2, math.MaxUint64 - 1}
+	for i := 0; i < 1000; i++ {
+		evens = append(evens, rng.Uint64()&^1)
+	}
+	values := make(map[uint64]unsafe.Pointer)
+	for _, k := range evens {
+		if hash(k, m.shift) != hash(k+1, m.shift) {
+			t.Fatalf("%d: expected %d and %d to share a desired slot", k, k, k+1)
+		}
+		for _, pk := range []uint64{k, k + 1} {
+			values[pk] = unsafe.Pointer(new(int))
+			m.Put(pk, values[pk])
+		}
+	}
+	if m.Len() != len(values) {
+		t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+	}
+	for _, e := range m.entries {
+		if e.value != nil && values[e.key] != e.value {
+			t.Fatalf("%d: stored key does not match its value", e.key)
+		}
+	}
+	for k, v := range values {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+
+	// Deleting one key of a pair leaves the other.
+	for _, k := range evens {
+		m.Delete(k + 1)
+		if p := m.Get(k + 1); p != nil {
+			t.Fatalf("%d: expected deleted, but found %p", k+1, p)
+		}
+		if p := m.Get(k); p != values[k] {
+			t.Fatalf("%d: expected %p, but found %p", k, values[k], p)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodHashShifts(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := []uint64{0, 1, math.MaxUint64, 1 << 63}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, rng.Uint64())
+	}
+	// The shift of a size-1 table, as computed by rehash.
+	size1Shift := uint32(64 - bits.Len32(0))
+	if size1Shift != 64 {
+		t.Fatalf("expected a shift of 64 for a size-1 table, but found %d", size1Shift)
+	}
+	for _, shift := range []uint32{33, 48, 63, size1Shift} {
+		size := uint64(1) << (64 - shift)
+		for _, k := range keys {
+			if h := hash(k, shift); uint64(h) >= size {
+				t.Fatalf("hash(%d, %d) = %d, expected < %d", k, shift, h, size)
+			}
+		}
+	}
+	// A shift of 0 is not used by any table, but returns the low 32 bits of
+	// the product rather than misbehaving.
+	for _, k := range keys {
+		if h, expected := hash(k, 0), uint32((k|1)*11400714819323198485); h != expected {
+			t.Fatalf("hash(%d, 0) = %d, expected %d", k, h, expected)
+		}
+	}
+}
+
+func TestRobinHoodSmallSizes(t *testing.T) {
+	for _, size := range []uint32{1, 2} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			m := &robinHoodMap{}
+			m.rehash(size)
+			for k := uint64(0); k < 1000; k++ {
+				if h := hash(k, m.shift); h >= m.size {
+					t.Fatalf("hash(%d) = %d, expected < %d", k, h, m.size)
+				}
+			}
+
+			values := make(map[uint64]unsafe.Pointer)
+			for i := uint64(1); i <= 64; i++ {
+				k := i * 7919
+				v := unsafe.Pointer(new(int))
+				values[k] = v
+				m.Put(k, v)
+			}
+			if m.count != uint32(len(values)) {
+				t.Fatalf("expected count %d, but found %d", len(values), m.count)
+			}
+			for k, v := range values {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+			for k := range values {
+				m.Delete(k)
+				if p := m.Get(k); p != nil {
+					t.Fatalf("%d: expected deleted, but found %p", k, p)
+				}
+			}
+			if m.count != 0 {
+				t.Fatalf("expected count 0, but found %d", m.count)
+			}
+		})
+	}
+
+	if m := newRobinHoodMap(0); m.size != 2 {
+		t.Fatalf("expected size 2, but found %d", m.size)
+	}
+}
+
+func TestRobinHoodGrowCarriedEntry(t *testing.T) {
+	// Build a table of size 2 (max dist 4) in which inserting a key displaces
+	// another entry, and the displaced entry is the one which reaches the max
+	// dist and grows the table:
+	//
+	//   slot:  0   1   2   3   4
+	//   key:   a0  a1  b0  b1  b2
+	//   dist:  0   1   1   2   3
+	//
+	// Inserting c, desired slot 0, swaps with b0 at slot 2. Carrying b0 onwards
+	// reaches dist 4 at slot 5, so the table grows while it holds c and b0 is
+	// the entry which must be reinserted.
+	var grows int
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+		onGrow: func(oldSize, newSize uint32) { grows++ },
+	})
+	if m.size != 2 || m.maxDist != 4 {
+		t.Fatalf("expected size 2 and max dist 4, but found %d and %d", m.size, m.maxDist)
+	}
+	slot0 := keysWithHash(m.shift, 0, 3)
+	slot1 := keysWithHash(m.shift, 1, 3)
+	a, b, c := slot0[:2], slot1, slot0[2]
+
+	values := make(map[uint64]unsafe.Pointer)
+	put := func(k uint64) {
+		values[k] = unsafe.Pointer(new(int))
+		m.Put(k, values[k])
+	}
+	for _, k := range append(a, b...) {
+		put(k)
+	}
+	if grows != 0 {
+		t.Fatalf("expected no grows, but found %d", grows)
+	}
+	for i, k := range append(a, b...) {
+		if e := m.entry(uint32(i)); e.key != k {
+			t.Fatalf("%d: expected key %d, but found %d", i, k, e.key)
+		}
+	}
+
+	put(c)
+	if grows != 1 {
+		t.Fatalf("expected 1 grow, but found %d", grows)
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.count != uint32(len(values)) {
+		t.Fatalf("expected count %d, but found %d", len(values), m.count)
+	}
+	for k, v := range values {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodMissAtMaxDist(t *testing.T) {
+	for _, policy := range []func(uint32) uint32{maxDistForSize, scaledMaxDist(2, 3)} {
+		m := newRobinHoodMapWithOptions(8, robinHoodOptions{maxDist: policy})
+		size, last := m.size, m.size-1
+
+		// Fill the padding with a chain hanging off the last desired slot. The
+		// chain is maxDist long: one more entry would grow the table.
+		keys := keysWithHash(m.shift, last, int(m.maxDist)+1)
+		for _, k := range keys[:m.maxDist] {
+			m.Put(k, unsafe.Pointer(new(int)))
+		}
+		if m.size != size {
+			t.Fatalf("expected size %d, but found %d", size, m.size)
+		}
+		n := uint32(len(m.entries))
+		if e := m.entry(n - 2); e.value == nil || e.dist != m.maxDist-1 {
+			t.Fatalf("expected last padding slot at dist %d, but found [%d,%v,%d]",
+				m.maxDist-1, e.key, e.value, e.dist)
+		}
+		if e := m.entry(n - 1); e.value != nil || e.dist != 0 {
+			t.Fatalf("expected empty sentinel, but found [%d,%v,%d]", e.key, e.value, e.dist)
+		}
+
+		// A miss starting at the last desired slot walks the whole chain and stops
+		// at the sentinel.
+		miss := keys[m.maxDist]
+		if p := m.Get(miss); p != nil {
+			t.Fatalf("%d: expected miss, but found %p", miss, p)
+		}
+		m.Delete(miss)
+		if m.count != m.maxDist {
+			t.Fatalf("expected count %d, but found %d", m.maxDist, m.count)
+		}
+	}
+}
+
+func TestRobinHoodAlign(t *testing.T) {
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected panic combining align and pool")
+			}
+		}()
+		newRobinHoodMapWithOptions(0, robinHoodOptions{align: true, pool: true})
+	}()
+
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{align: true})
+	expectAligned := func(op string) {
+		t.Helper()
+		if p := uintptr(m.entriesPtr); p%cacheLineSize != 0 {
+			t.Fatalf("%s: expected entries aligned to %d bytes, but found %#x", op, cacheLineSize, p)
+		}
+		if unsafe.Pointer(&m.entries[0]) != m.entriesPtr {
+			t.Fatalf("%s: entriesPtr does not point at the first entry", op)
+		}
+	}
+	expectAligned("new")
+	for k := uint64(0); k < 10000; k++ {
+		size := m.size
+		m.Put(k, unsafe.Pointer(new(int)))
+		if m.size != size {
+			expectAligned("grow")
+		}
+	}
+	m.ResizeTo(1 << 16)
+	expectAligned("resize")
+	m.Snapshot()
+	m.Delete(1)
+	expectAligned("unshare")
+
+	for k := uint64(2); k < 10000; k++ {
+		if m.Get(k) == nil {
+			t.Fatalf("%d: expected present", k)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodGeneration(t *testing.T) {
+	m := newRobinHoodMap(0)
+	gen := m.Generation()
+	expect := func(changed bool, op string) {
+		t.Helper()
+		if g := m.Generation(); (g != gen) != changed {
+			t.Fatalf("%s: expected changed=%t, but generation went from %d to %d", op, changed, gen, g)
+		}
+		gen = m.Generation()
+	}
+	m.Put(1, unsafe.Pointer(new(int)))
+	expect(true, "insert")
+	m.Put(1, unsafe.Pointer(new(int)))
+	expect(false, "replace")
+	m.Delete(2)
+	expect(false, "delete missing")
+	m.Delete(1)
+	expect(true, "delete")
+	m.Reserve(1000)
+	expect(true, "rehash")
+	m.Get(1)
+	expect(false, "get")
+
+	// A TryPut which grows the table moves every entry.
+	v := unsafe.Pointer(new(int))
+	for k := uint64(1); ; k++ {
+		size := m.size
+		if err := m.TryPut(k*7919, v); err != nil {
+			t.Fatal(err)
+		}
+		if m.size != size {
+			expect(true, "try put growth")
+			break
+		}
+		gen = m.Generation()
+	}
+}
+
+func TestRobinHoodSwapCount(t *testing.T) {
+	// The a keys desire slot 0, and b and c desire slot 1. The final layout
+	// is:
+	//
+	//   slot:  0   1   2   3   4   5
+	//   key:   a0  a1  a2  a3  c   b
+	//   dist:  0   1   2   3   3   4
+	m := newRobinHoodMapWithOptions(16, robinHoodOptions{maxDist: func(uint32) uint32 { return 8 }})
+	a := collidingKeys(4)
+	bc := keysWithHash(m.shift, 1, 2)
+	b, c := bc[0], bc[1]
+	steps := []struct {
+		key   uint64
+		swaps int
+	}{
+		{b, 0},
+		{a[0], 0},
+		// a1 displaces b from slot 1.
+		{a[1], 1},
+		// a2 displaces b from slot 2.
+		{a[2], 1},
+		// c is no richer than any entry it passes.
+		{c, 0},
+		// a3 displaces b from slot 3, and b is no richer than c.
+		{a[3], 1},
+		// Replacing a value displaces nothing.
+		{b, 0},
+	}
+	var total uint64
+	for i, s := range steps {
+		if swaps := m.PutSwaps(s.key, unsafe.Pointer(new(int))); swaps != s.swaps {
+			t.Fatalf("%d: expected %d swaps, but found %d", i, s.swaps, swaps)
+		}
+		total += uint64(s.swaps)
+		if n := m.SwapCount(); n != total {
+			t.Fatalf("%d: expected %d total swaps, but found %d", i, total, n)
+		}
+	}
+	for slot, k := range []uint64{a[0], a[1], a[2], a[3], c, b} {
+		if _, actual, _, _ := m.SlotInfo(k); actual != uint32(slot) {
+			t.Fatalf("%d: expected slot %d, but found %d", k, slot, actual)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodRehashWork(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var m *robinHoodMap
+	var grows int
+	var reinserted uint64
+	m = newRobinHoodMapWithOptions(0, robinHoodOptions{
+		onGrow: func(oldSize, newSize uint32) {
+			grows++
+			reinserted += uint64(m.Len())
+		},
+	})
+	if w := m.RehashWork(); w != 0 {
+		t.Fatalf("expected no rehash work, but found %d", w)
+	}
+	for i := 0; i < 10000; i++ {
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+	}
+	if grows < 5 {
+		t.Fatalf("expected at least 5 grows, but found %d", grows)
+	}
+	if w := m.RehashWork(); w < reinserted {
+		t.Fatalf("expected rehash work of at least %d, but found %d", reinserted, w)
+	}
+
+	// Resizing explicitly reinserts every entry.
+	before := m.RehashWork()
+	m.ResizeTo(int(2 * m.size))
+	if w := m.RehashWork() - before; w < uint64(m.Len()) {
+		t.Fatalf("expected rehash work of at least %d, but found %d", m.Len(), w)
+	}
+}
+
+func TestRobinHoodStats(t *testing.T) {
+	m := newRobinHoodMap(0)
+	if s := m.Stats(); s.Count != 0 || s.MaxDist != 0 || s.AvgDist != 0 {
+		t.Fatalf("unexpected stats for empty map: %+v", s)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 1000; i++ {
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+	}
+	expected := MapStats{
+		Count:       m.Len(),
+		Size:        m.size,
+		LoadFactor:  m.LoadFactor(),
+		MaxDist:     m.MaxDist(),
+		AvgDist:     m.AvgDist(),
+		MemoryUsage: m.MemoryUsage(),
+	}
+	if s := m.Stats(); s != expected {
+		t.Fatalf("expected %+v, but found %+v", expected, s)
+	}
+	if expected.MaxDist == 0 || expected.AvgDist == 0 {
+		t.Fatalf("expected non-zero distances: %+v", expected)
+	}
+}
+
+func TestRobinHoodCheckInvariantsCorruption(t *testing.T) {
+	// Build a chain of 3 entries occupying slots [3,5].
+	build := func() *robinHoodMap {
+		m := newRobinHoodMap(8)
+		for _, k := range keysWithHash(m.shift, 3, 3) {
+			m.Put(k, unsafe.Pointer(new(int)))
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	corruptions := []func(m *robinHoodMap){
+		func(m *robinHoodMap) { m.count++ },
+		func(m *robinHoodMap) { m.entry(4).dist = 2 },
+		func(m *robinHoodMap) { *m.entry(3) = robinHoodEntry{} },
+		func(m *robinHoodMap) { m.entry(7).dist = 1 },
+		func(m *robinHoodMap) { m.entries[len(m.entries)-1].dist = 1 },
+	}
+	for i, corrupt := range corruptions {
+		m := build()
+		corrupt(m)
+		if err := m.checkInvariants(); err == nil {
+			t.Fatalf("%d: expected corruption to be detected", i)
+		}
+	}
+}
+
+func TestRobinHoodMaxRun(t *testing.T) {
+	m := newRobinHoodMapWithOptions(8, robinHoodOptions{maxDist: func(uint32) uint32 { return 8 }})
+	if n := m.MaxRun(); n != 0 {
+		t.Fatalf("expected 0, but found %d", n)
+	}
+	// Slots 0-3 hold 4 colliding keys and slot 4 a key at its desired slot,
+	// forming a run of 5. Slots 8-9 hold adjacent keys at their desired
+	// slots, which form a run of 2 although neither is displaced.
+	colliding := collidingKeys(4)
+	for _, k := range colliding {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	for _, h := range []uint32{4, 8, 9} {
+		m.Put(keysWithHash(m.shift, h, 1)[0], unsafe.Pointer(new(int)))
+	}
+	if n := m.MaxRun(); n != 5 {
+		t.Fatalf("expected 5, but found %d", n)
+	}
+	if m.MaxDist() != 3 {
+		t.Fatalf("expected max dist 3, but found %d", m.MaxDist())
+	}
+
+	// Deleting a colliding key shifts the others back, leaving slot 3 empty
+	// and the key in slot 4 on its own.
+	m.Delete(colliding[0])
+	if n := m.MaxRun(); n != 3 {
+		t.Fatalf("expected 3, but found %d", n)
+	}
+}
+
+func TestRobinHoodCountAtLeastDist(t *testing.T) {
+	// A run of 4 colliding keys at dists 0-3, and 2 keys at their desired
+	// slots beyond it.
+	m := newRobinHoodMapWithOptions(8, robinHoodOptions{maxDist: func(uint32) uint32 { return 8 }})
+	for _, k := range collidingKeys(4) {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	for _, h := range []uint32{8, 12} {
+		m.Put(keysWithHash(m.shift, h, 1)[0], unsafe.Pointer(new(int)))
+	}
+
+	for d, expected := range []int{6, 3, 2, 1, 0, 0} {
+		if n := m.CountAtLeastDist(uint32(d)); n != expected {
+			t.Fatalf("%d: expected %d, but found %d", d, expected, n)
+		}
+	}
+	if m.CountAtLeastDist(0) != m.Len() {
+		t.Fatalf("expected every entry at dist >= 0")
+	}
+}
+
+func TestRobinHoodNeedsGrow(t *testing.T) {
+	// Colliding keys form a single run with dists 0, 1, 2, ... The 8th key
+	// is at dist 7, after which inserting another colliding key would reach
+	// maxDist.
+	m := newRobinHoodMapWithOptions(8, robinHoodOptions{maxDist: func(uint32) uint32 { return 8 }})
+	for i, k := range collidingKeys(8) {
+		if m.NeedsGrow() {
+			t.Fatalf("%d: expected no grow to be needed", i)
+		}
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	if !m.NeedsGrow() {
+		t.Fatalf("expected a grow to be needed at max dist %d", m.MaxDist())
+	}
+	m.Delete(collidingKeys(8)[7])
+	if m.NeedsGrow() {
+		t.Fatalf("expected no grow to be needed after delete")
+	}
+
+	// With random keys, the table never grows without NeedsGrow having
+	// returned true beforehand.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var grew bool
+	m = newRobinHoodMapWithOptions(0, robinHoodOptions{
+		onGrow: func(oldSize, newSize uint32) { grew = true },
+	})
+	var grows int
+	for i := 0; i < 10000; i++ {
+		needsGrow := m.NeedsGrow()
+		grew = false
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+		if grew {
+			if !needsGrow {
+				t.Fatalf("%d: grew to %d without NeedsGrow", i, m.size)
+			}
+			grows++
+		}
+	}
+	if grows == 0 {
+		t.Fatalf("expected at least one grow")
+	}
+}
+
+// rawInsert stores an entry for key k directly in the first empty slot at or
+// after its desired slot, bypassing the check for an existing entry. It
+// models the duplicates created by the Put of earlier versions.
+func rawInsert(m *robinHoodMap, k uint64, v unsafe.Pointer) {
+	desired := m.hash(k)
+	for i := desired; ; i++ {
+		if e := &m.entries[i]; e.value == nil {
+			*e = robinHoodEntry{key: k, value: v, dist: i - desired}
+			m.count++
+			return
+		}
+	}
+}
+
+func TestRobinHoodDuplicates(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(1000)
+	keys := make([]uint64, 100)
+	for i := range keys {
+		keys[i] = uint64(rng.Int63())
+		m.Put(keys[i], unsafe.Pointer(new(int)))
+	}
+	if dups := m.Duplicates(); len(dups) != 0 {
+		t.Fatalf("expected no duplicates, but found %v", dups)
+	}
+
+	// A key duplicated twice is reported once.
+	expected := []uint64{keys[3], keys[42]}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	rawInsert(m, keys[3], unsafe.Pointer(new(int)))
+	rawInsert(m, keys[42], unsafe.Pointer(new(int)))
+	rawInsert(m, keys[42], unsafe.Pointer(new(int)))
+	if dups := m.Duplicates(); fmt.Sprint(dups) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, but found %v", expected, dups)
+	}
+}
+
+func TestRobinHoodRecomputeCount(t *testing.T) {
+	m := newRobinHoodMap(0)
+	for i := uint64(1); i <= 100; i++ {
+		m.Put(i, unsafe.Pointer(new(int)))
+	}
+	if delta := m.RecomputeCount(); delta != 0 {
+		t.Fatalf("expected no correction, but found %d", delta)
+	}
+
+	for _, corrupt := range []uint32{0, 90, 150} {
+		m.count = corrupt
+		if delta := m.RecomputeCount(); delta != 100-int(corrupt) {
+			t.Fatalf("expected correction %d, but found %d", 100-int(corrupt), delta)
+		}
+		if m.Len() != 100 {
+			t.Fatalf("expected 100 entries, but found %d", m.Len())
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobinHoodFromGoMap(t *testing.T) {
+	if m := fromGoMap(nil); m.Len() != 0 || len(m.Keys()) != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+
+	src := make(map[uint64]unsafe.Pointer)
+	for i := uint64(0); i < 1000; i++ {
+		src[i*7919] = unsafe.Pointer(new(int))
+	}
+	m := fromGoMap(src)
+	if m.size != sizeForCapacity(len(src)) {
+		t.Fatalf("expected size %d, but found %d", sizeForCapacity(len(src)), m.size)
+	}
+	keys := m.Keys()
+	if len(keys) != len(src) {
+		t.Fatalf("expected %d keys, but found %d", len(src), len(keys))
+	}
+	for _, k := range keys {
+		if v, ok := src[k]; !ok || m.Get(k) != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, m.Get(k))
+		}
+	}
+}
+
+func TestRobinHoodToGoMap(t *testing.T) {
+	if dst := newRobinHoodMap(0).ToGoMap(); len(dst) != 0 {
+		t.Fatalf("expected empty map, but found %d entries", len(dst))
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	for i := 0; i < 1000; i++ {
+		m.Put(uint64(rng.Intn(1<<20)), unsafe.Pointer(new(int)))
+	}
+	dst := m.ToGoMap()
+	if len(dst) != m.Len() {
+		t.Fatalf("expected %d entries, but found %d", m.Len(), len(dst))
+	}
+	m.Range(func(k uint64, v unsafe.Pointer) bool {
+		if dst[k] != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, dst[k])
+		}
+		return true
+	})
+}
+
+// fullRobinHoodMap returns a map filled with random keys until the table is
+// on the verge of growing.
+func fullRobinHoodMap(rng *rand.Rand, initialCapacity int) *robinHoodMap {
+	m := newRobinHoodMap(initialCapacity)
+	v := unsafe.Pointer(new(int))
+	for misses := 0; misses < 100 && m.Len() < int(m.size); {
+		k := uint64(rng.Int63())
+		if !m.fits(k) {
+			misses++
+			continue
+		}
+		m.Put(k, v)
+	}
+	return m
+}
+
+// rehashInOrder is rehash, but reinserts the old entries in the order given
+// by less.
+func rehashInOrder(m *robinHoodMap, size uint32, less func(a, b *robinHoodEntry) bool) {
+	old := make([]robinHoodEntry, 0, m.count)
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			old = append(old, *e)
+		}
+	}
+	if less != nil {
+		sort.SliceStable(old, func(i, j int) bool { return less(&old[i], &old[j]) })
+	}
+	m.entries = nil
+	m.rehash(size)
+	for i := range old {
+		m.put(old[i].key, old[i].value, true)
+	}
+}
+
+func TestRobinHoodRehashOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	src := fullRobinHoodMap(rng, 1<<10)
+	byDist := func(a, b *robinHoodEntry) bool { return a.dist > b.dist }
+
+	m1 := &robinHoodMap{}
+	*m1 = *src
+	m1.entries = append([]robinHoodEntry(nil), src.entries...)
+	m1.rehash(2 * src.size)
+	m2 := &robinHoodMap{}
+	*m2 = *src
+	m2.entries = append([]robinHoodEntry(nil), src.entries...)
+	rehashInOrder(m2, 2*src.size, byDist)
+
+	for _, m := range []*robinHoodMap{m1, m2} {
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != src.Len() {
+			t.Fatalf("expected %d entries, but found %d", src.Len(), m.Len())
+		}
+	}
+	if s1, s2 := m1.Stats(), m2.Stats(); s1.MaxDist != s2.MaxDist || s1.AvgDist != s2.AvgDist {
+		t.Fatalf("expected reinsertion order not to affect distances: %+v vs %+v", s1, s2)
+	}
+}
+
+func TestRobinHoodRehashInPlace(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(1 << 10)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	check := func() {
+		t.Helper()
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+
+	size, ptr, max := m.size, m.entriesPtr, m.MaxDist()
+	if m.rehashInPlace(max) {
+		t.Fatalf("expected max dist %d to be rejected", max)
+	}
+
+	// Shrinking and then regrowing the padding within capacity reuses the
+	// storage.
+	for _, d := range []uint32{max + 1, m.maxDist, max + 2} {
+		if !m.rehashInPlace(d) {
+			t.Fatalf("expected max dist %d to be accepted", d)
+		}
+		if m.size != size || m.maxDist != d || m.entriesPtr != ptr {
+			t.Fatalf("expected in-place rehash to max dist %d", d)
+		}
+		check()
+	}
+
+	// Growing beyond the capacity copies the entries.
+	if !m.rehashInPlace(uint32(cap(m.entries)) - m.size + 1) {
+		t.Fatalf("expected larger max dist to be accepted")
+	}
+	if m.entriesPtr == ptr {
+		t.Fatalf("expected entries to be reallocated")
+	}
+	check()
+
+	// Resizing to the current size narrows the padding back to the threshold
+	// for the size, reusing the storage.
+	ptr = m.entriesPtr
+	m.ResizeTo(int(m.size))
+	if m.size != size || m.maxDist != m.maxDistForSize(size) || m.entriesPtr != ptr {
+		t.Fatalf("expected in-place resize to max dist %d", m.maxDistForSize(size))
+	}
+	check()
+
+	// Inserting after the padding changed still works, growing as needed.
+	for i := 0; i < 5000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	check()
+}
+
+func TestGrownSize(t *testing.T) {
+	for _, size := range []uint32{1, 2, 1 << 20, maxSize >> 1} {
+		if n := grownSize(size, defaultGrowth); n != 2*size {
+			t.Fatalf("grownSize(%d) = %d, expected %d", size, n, 2*size)
+		}
+	}
+
+	for _, factor := range []float64{1.0001, 1.5, 2, 3, 4.5} {
+		for size := uint32(1); size <= maxSize>>4; size <<= 1 {
+			n := grownSize(size, factor)
+			if n <= size || n&(n-1) != 0 {
+				t.Fatalf("grownSize(%d, %v) = %d, expected a larger power of 2", size, factor, n)
+			}
+		}
+	}
+	if n := grownSize(maxSize>>1, 8); n != maxSize {
+		t.Fatalf("expected growth to be capped at %d, but found %d", uint32(maxSize), n)
+	}
+
+	for _, size := range []uint32{maxSize, 1<<32 - 1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("grownSize(%d): expected panic", size)
+				}
+			}()
+			n := grownSize(size, defaultGrowth)
+			t.Fatalf("grownSize(%d) = %d, expected panic", size, n)
+		}()
+	}
+}
+
+func TestRobinHoodGrowth(t *testing.T) {
+	for _, factor := range []float64{1, 0.5, -2, math.NaN()} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("factor %v: expected panic", factor)
+				}
+			}()
+			newRobinHoodMapWithGrowth(0, factor)
+		}()
+	}
+
+	for _, factor := range []float64{1.0001, 1.5, 3} {
+		t.Run(fmt.Sprint(factor), func(t *testing.T) {
+			m := newRobinHoodMapWithGrowth(0, factor)
+			values := make(map[uint64]unsafe.Pointer)
+			for i := uint64(1); i <= 1000; i++ {
+				k := i * 7919
+				values[k] = unsafe.Pointer(new(int))
+				m.Put(k, values[k])
+				if m.size&(m.size-1) != 0 {
+					t.Fatalf("size %d is not a power of 2", m.size)
+				}
+			}
+			for k, v := range values {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+		})
+	}
+}
+
+func TestRobinHoodMaxDistPolicy(t *testing.T) {
+	// 7000 keys fit in a table of 8192 entries only if probes are allowed to be
+	// longer than the default threshold.
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]uint64, 7000)
+	for i := range keys {
+		keys[i] = uint64(rng.Int63())
+	}
+	v := unsafe.Pointer(new(int))
+
+	rehashes := func(policy func(uint32) uint32) int {
+		var n int
+		m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+			maxDist: func(size uint32) uint32 {
+				n++
+				return policy(size)
+			},
+		})
+		for _, k := range keys {
+			m.Put(k, v)
+		}
+		for _, k := range keys {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+		return n
+	}
+
+	base := rehashes(maxDistForSize)
+	scaled := rehashes(scaledMaxDist(2, 8))
+	if scaled >= base {
+		t.Fatalf("expected fewer than %d rehashes with a larger max dist, but found %d", base, scaled)
+	}
+
+	// A threshold below minMaxDist is raised to it.
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+		maxDist: func(uint32) uint32 { return 0 },
+	})
+	if m.maxDist != minMaxDist {
+		t.Fatalf("expected max dist %d, but found %d", minMaxDist, m.maxDist)
+	}
+}
+
+func TestRobinHoodMaxDistFloor(t *testing.T) {
+	testCases := []struct {
+		floor    uint32
+		expected uint32
+	}{
+		{0, defaultMaxDistFloor},
+		{1, minMaxDist},
+		{2, 2},
+		{3, 3},
+		{8, 8},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(c.floor), func(t *testing.T) {
+			m := newRobinHoodMapWithOptions(0, robinHoodOptions{maxDistFloor: c.floor})
+			if m.size != 2 {
+				t.Fatalf("expected size 2, but found %d", m.size)
+			}
+			if m.maxDist != c.expected {
+				t.Fatalf("expected max dist %d, but found %d", c.expected, m.maxDist)
+			}
+			if n := len(m.entries); n != int(2+c.expected) {
+				t.Fatalf("expected %d entries, but found %d", 2+c.expected, n)
+			}
+
+			ref := make(map[uint64]unsafe.Pointer)
+			for i := uint64(0); i < 1000; i++ {
+				ref[i*7919] = unsafe.Pointer(new(int))
+				m.Put(i*7919, ref[i*7919])
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+			// Large tables are unaffected by a small floor.
+			if expected := maxDistWithFloor(m.size, c.expected); m.maxDist != expected {
+				t.Fatalf("expected max dist %d, but found %d", expected, m.maxDist)
+			}
+		})
+	}
+}
+
+func TestRobinHoodPutIfAbsent(t *testing.T) {
+	m := newRobinHoodMap(0)
+	a := unsafe.Pointer(new(int))
+	b := unsafe.Pointer(new(int))
+
+	for i := uint64(1); i <= 100; i++ {
+		if !m.PutIfAbsent(i*7919, a) {
+			t.Fatalf("%d: expected first insert to succeed", i*7919)
+		}
+	}
+	for i := uint64(1); i <= 100; i++ {
+		if m.PutIfAbsent(i*7919, b) {
+			t.Fatalf("%d: expected second insert to fail", i*7919)
+		}
+		if p := m.Get(i * 7919); p != a {
+			t.Fatalf("%d: expected %p, but found %p", i*7919, a, p)
+		}
+	}
+	if m.count != 100 {
+		t.Fatalf("expected count 100, but found %d", m.count)
+	}
+
+	// Put replaces the value of an existing key rather than adding a duplicate.
+	m.Put(7919, b)
+	if p := m.Get(7919); p != b {
+		t.Fatalf("expected %p, but found %p", b, p)
+	}
+	if m.count != 100 {
+		t.Fatalf("expected count 100, but found %d", m.count)
+	}
+}
+
+func TestRobinHoodPutNil(t *testing.T) {
+	m := newRobinHoodMap(0)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected panic")
+		}
+		if m.Len() != 0 {
+			t.Fatalf("expected empty map, but found %d entries", m.Len())
+		}
+	}()
+	m.Put(1, nil)
+}
+
+func TestRobinHoodDeleteBeforeDistZero(t *testing.T) {
+	// Delete x from the layout:
+	//
+	//   slot:  0   1   2
+	//   key:   x   y   z
+	//   dist:  0   0   1
+	//
+	// y is at its desired slot, so the backward shift stops at y's dist of 0,
+	// leaving slot 0 empty. z, which shares y's desired slot, must stay put.
+	m := newRobinHoodMap(4)
+	x := keysWithHash(m.shift, 0, 1)[0]
+	yz := keysWithHash(m.shift, 1, 2)
+	y, z := yz[0], yz[1]
+	values := map[uint64]unsafe.Pointer{
+		x: unsafe.Pointer(new(int)),
+		y: unsafe.Pointer(new(int)),
+		z: unsafe.Pointer(new(int)),
+	}
+	for _, k := range []uint64{x, y, z} {
+		m.Put(k, values[k])
+	}
+	expect := func(layout ...robinHoodEntry) {
+		t.Helper()
+		for i, e := range layout {
+			if m.entries[i] != e {
+				t.Fatalf("%d: expected %v, but found %v", i, e, m.entries[i])
+			}
+		}
+	}
+	expect(
+		robinHoodEntry{x, values[x], 0},
+		robinHoodEntry{y, values[y], 0},
+		robinHoodEntry{z, values[z], 1},
+		robinHoodEntry{},
+	)
+
+	m.Delete(x)
+	expect(
+		robinHoodEntry{},
+		robinHoodEntry{y, values[y], 0},
+		robinHoodEntry{z, values[z], 1},
+		robinHoodEntry{},
+	)
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.Get(x); p != nil {
+		t.Fatalf("%d: expected deleted, but found %p", x, p)
+	}
+	for _, k := range []uint64{y, z} {
+		if p := m.Get(k); p != values[k] {
+			t.Fatalf("%d: expected %p, but found %p", k, values[k], p)
+		}
+	}
+}
+
+func TestRobinHoodDeleteMissing(t *testing.T) {
+	// An empty map has no entries to shift, and its zero-valued slots have key
+	// 0, so deleting key 0 must not match an empty slot. A key hashing to the
+	// last slot probes into the padding.
+	m := newRobinHoodMap(0)
+	missing := []uint64{0, 1, math.MaxUint64, keysWithHash(m.shift, m.size-1, 1)[0]}
+	for _, k := range missing {
+		m.Delete(k)
+		if m.Len() != 0 || m.count != 0 {
+			t.Fatalf("%d: expected empty map, but found %d entries", k, m.Len())
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys which were never present, including one which collides with a
+	// run of entries and one hashing to the last slot, leave the map as is.
+	m = newRobinHoodMap(16)
+	for _, k := range collidingKeys(4) {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	for i := uint64(1); i <= 8; i++ {
+		m.Put(i*1000, unsafe.Pointer(new(int)))
+	}
+	n := m.Len()
+	before := append([]robinHoodEntry(nil), m.entries...)
+	missing = []uint64{0, collidingKeys(5)[4], keysWithHash(m.shift, m.size-1, 1)[0]}
+	for _, k := range missing {
+		m.Delete(k)
+		if m.Len() != n {
+			t.Fatalf("%d: expected %d entries, but found %d", k, n, m.Len())
+		}
+	}
+	for i := range before {
+		if m.entries[i] != before[i] {
+			t.Fatalf("%d: expected %v, but found %v", i, before[i], m.entries[i])
+		}
+	}
+	if delta := m.RecomputeCount(); delta != 0 {
+		t.Fatalf("expected no correction to the count, but found %d", delta)
+	}
+}
+
+func TestRobinHoodDeleteClearsValues(t *testing.T) {
+	// Colliding keys form a single run which every deletion shifts.
+	m := newRobinHoodMap(0)
+	keys := collidingKeys(int(m.maxDist))
+	values := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		values[i] = unsafe.Pointer(new(int))
+		m.Put(k, values[i])
+	}
+	for _, i := range []int{1, 0, len(keys) - 1, 2} {
+		m.Delete(keys[i])
+		for j := range m.entries {
+			if e := &m.entries[j]; e.value == values[i] {
+				t.Fatalf("%d: stale value for deleted key %d", j, keys[i])
+			} else if e.value == nil && *e != (robinHoodEntry{}) {
+				t.Fatalf("%d: expected zero entry, but found %v", j, *e)
+			}
+		}
+	}
+
+	// Deleted values become unreachable.
+	const n = 100
+	finalized := make(chan struct{}, n)
+	m = newRobinHoodMap(0)
+	for i := uint64(0); i < n; i++ {
+		v := new([64]byte)
+		runtime.SetFinalizer(v, func(*[64]byte) { finalized <- struct{}{} })
+		m.Put(i, unsafe.Pointer(v))
+	}
+	for i := uint64(0); i < n; i++ {
+		m.Delete(i)
+	}
+	deadline := time.After(10 * time.Second)
+	for i := 0; i < n; {
+		runtime.GC()
+		select {
+		case <-finalized:
+			i++
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("expected %d values to be finalized, but found %d", n, i)
+		}
+	}
+	runtime.KeepAlive(m)
+}
+
+func TestRobinHoodSubtractKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	other := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	// Colliding keys form runs which every removal shifts.
+	for _, k := range collidingKeys(8) {
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	for _, k := range collidingKeys(12)[4:] {
+		other.Put(k, unsafe.Pointer(new(int)))
+	}
+	for i := 0; i < 2000; i++ {
+		k := uint64(rng.Intn(4000))
+		if i%2 == 0 {
+			ref[k] = unsafe.Pointer(new(int))
+			m.Put(k, ref[k])
+		} else {
+			other.Put(k, unsafe.Pointer(new(int)))
+		}
+	}
+
+	var expected int
+	other.Range(func(k uint64, _ unsafe.Pointer) bool {
+		if _, ok := ref[k]; ok {
+			delete(ref, k)
+			expected++
+		}
+		return true
+	})
+	otherLen := other.Len()
+	if n := m.SubtractKeys(other); n != expected {
+		t.Fatalf("expected %d removed, but found %d", expected, n)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if other.Len() != otherLen {
+		t.Fatalf("expected other to keep %d entries, but found %d", otherLen, other.Len())
+	}
+
+	if n := m.SubtractKeys(other); n != 0 {
+		t.Fatalf("expected nothing removed, but found %d", n)
+	}
+	if n := m.SubtractKeys(m); n != len(ref) || m.Len() != 0 {
+		t.Fatalf("expected %d removed leaving an empty map, but found %d and %d entries", len(ref), n, m.Len())
+	}
+}
+
+func TestRobinHoodDiff(t *testing.T) {
+	v1, v2, v3 := unsafe.Pointer(new(int)), unsafe.Pointer(new(int)), unsafe.Pointer(new(int))
+	before := newRobinHoodMap(0)
+	before.Put(1, v1) // unchanged
+	before.Put(2, v1) // changed
+	before.Put(3, v2) // removed
+	before.Put(4, v3) // removed
+	before.Put(5, v2) // changed
+
+	after := newRobinHoodMap(0)
+	after.Put(1, v1)
+	after.Put(2, v2)
+	after.Put(5, v3)
+	after.Put(6, v1) // added
+	after.Put(0, v3) // added
+
+	added, removed, changed := after.Diff(before)
+	for _, c := range []struct {
+		name     string
+		keys     []uint64
+		expected []uint64
+	}{
+		{"added", added, []uint64{0, 6}},
+		{"removed", removed, []uint64{3, 4}},
+		{"changed", changed, []uint64{2, 5}},
+	} {
+		if fmt.Sprint(c.keys) != fmt.Sprint(c.expected) {
+			t.Fatalf("%s: expected %v, but found %v", c.name, c.expected, c.keys)
+		}
+	}
+
+	// The diff in the other direction swaps added and removed.
+	added, removed, changed = before.Diff(after)
+	if fmt.Sprint(added, removed, changed) != "[3 4] [0 6] [2 5]" {
+		t.Fatalf("expected [3 4] [0 6] [2 5], but found %v %v %v", added, removed, changed)
+	}
+	// Identical maps have no differences.
+	if added, removed, changed := after.Diff(after); added != nil || removed != nil || changed != nil {
+		t.Fatalf("expected no differences, but found %v %v %v", added, removed, changed)
+	}
+}
+
+func TestRobinHoodOnEvict(t *testing.T) {
+	evicted := make(map[unsafe.Pointer]int)
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+		onEvict: func(k uint64, v unsafe.Pointer) {
+			if *(*uint64)(v) != k {
+				t.Fatalf("%d: evicted the value of key %d", k, *(*uint64)(v))
+			}
+			evicted[v]++
+		},
+	})
+	newValue := func(k uint64) unsafe.Pointer {
+		v := new(uint64)
+		*v = k
+		return unsafe.Pointer(v)
+	}
+	values := make(map[uint64]unsafe.Pointer)
+	for k := uint64(0); k < 1000; k++ {
+		values[k] = newValue(k)
+		m.Put(k, values[k])
+	}
+	expectEvicted := func(expected ...unsafe.Pointer) {
+		t.Helper()
+		for _, v := range expected {
+			if evicted[v] != 1 {
+				t.Fatalf("%d: expected 1 eviction, but found %d", *(*uint64)(v), evicted[v])
+			}
+			delete(evicted, v)
+		}
+		if len(evicted) != 0 {
+			t.Fatalf("expected no other evictions, but found %d", len(evicted))
+		}
+	}
+	// Growing the table while inserting evicts nothing.
+	expectEvicted()
+
+	// Reinserting the same pointer is a no-op.
+	m.Put(1, values[1])
+	m.PutBatch([]uint64{2}, []unsafe.Pointer{values[2]})
+	expectEvicted()
+
+	old := values[1]
+	values[1] = newValue(1)
+	m.Put(1, values[1])
+	expectEvicted(old)
+
+	m.Delete(2)
+	m.Delete(2)
+	expectEvicted(values[2])
+	delete(values, 2)
+
+	old = values[3]
+	values[3] = newValue(3)
+	if !m.CompareAndSwap(3, old, values[3]) {
+		t.Fatalf("expected the swap to be performed")
+	}
+	expectEvicted(old)
+
+	m.DeleteBatch([]uint64{4, 5, 5})
+	expectEvicted(values[4], values[5])
+	delete(values, 4)
+	delete(values, 5)
+
+	m.RemoveIf(func(k uint64, v unsafe.Pointer) bool { return k == 6 })
+	expectEvicted(values[6])
+	delete(values, 6)
+
+	// Values returned to the caller are not evicted.
+	m.LoadAndDelete(7)
+	delete(values, 7)
+	values[8] = newValue(8)
+	m.Swap(8, values[8])
+	k, _, _ := m.PopAny()
+	delete(values, k)
+	expectEvicted()
+
+	// Clearing evicts every remaining value.
+	var remaining []unsafe.Pointer
+	for _, v := range values {
+		remaining = append(remaining, v)
+	}
+	m.Clear()
+	expectEvicted(remaining...)
+	if m.Len() != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+}
+
+func TestRobinHoodClone(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// The source is sized for more entries than it holds, so that a clone sized
+	// for its entries is smaller.
+	m := newRobinHoodMapWithOptions(20000, robinHoodOptions{mix: true, occupancy: true})
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 5000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	check := func(c *robinHoodMap) {
+		t.Helper()
+		if err := c.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if c.Len() != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), c.Len())
+		}
+		for k, v := range ref {
+			if p := c.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+
+	c := m.Clone()
+	check(c)
+	if c.size != m.size {
+		t.Fatalf("expected size %d, but found %d", m.size, c.size)
+	}
+	// The clone is independent of the map.
+	c.Put(1, unsafe.Pointer(new(int)))
+	c.Delete(m.Keys()[0])
+	check(m)
+
+	for _, n := range []int{0, 100, len(ref), 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			c := m.CloneWithCapacity(n)
+			check(c)
+			expected := sizeForCapacity(n)
+			if n < len(ref) {
+				// The copy is sized for the entries, though the reinsertions may
+				// grow it further.
+				expected = sizeForCapacity(len(ref))
+			}
+			if c.size < expected {
+				t.Fatalf("expected size at least %d, but found %d", expected, c.size)
+			}
+			if n >= len(ref) && c.size != expected {
+				t.Fatalf("expected size %d, but found %d", expected, c.size)
+			}
+		})
+	}
+	if c := m.CloneWithCapacity(0); c.size >= m.size {
+		t.Fatalf("expected a smaller table than %d, but found %d", m.size, c.size)
+	}
+	if c := m.CloneWithCapacity(100000); c.size <= m.size {
+		t.Fatalf("expected a larger table than %d, but found %d", m.size, c.size)
+	}
+}
+
+func TestRobinHoodIntersect(t *testing.T) {
+	// The keys of each map are i*7919 for i in [lo,hi).
+	testCases := []struct {
+		name           string
+		aLo, aHi       int
+		bLo, bHi       int
+		expectedCommon int
+	}{
+		{"disjoint", 0, 1000, 1000, 1500, 0},
+		{"partial", 0, 1000, 500, 1500, 500},
+		{"partial-larger-other", 0, 200, 100, 2100, 100},
+		{"full", 0, 1000, 0, 1000, 1000},
+		{"empty", 0, 0, 0, 1000, 0},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			build := func(lo, hi int) (*robinHoodMap, map[uint64]unsafe.Pointer) {
+				m := newRobinHoodMap(0)
+				ref := make(map[uint64]unsafe.Pointer)
+				for i := lo; i < hi; i++ {
+					k := uint64(i) * 7919
+					ref[k] = unsafe.Pointer(new(int))
+					m.Put(k, ref[k])
+				}
+				return m, ref
+			}
+			a, refA := build(c.aLo, c.aHi)
+			b, refB := build(c.bLo, c.bHi)
+
+			expected := make(map[uint64]unsafe.Pointer)
+			for k, v := range refA {
+				if _, ok := refB[k]; ok {
+					expected[k] = v
+				}
+			}
+			if len(expected) != c.expectedCommon {
+				t.Fatalf("expected %d common keys, but found %d", c.expectedCommon, len(expected))
+			}
+			result := a.Intersect(b)
+			if result.Len() != len(expected) {
+				t.Fatalf("expected %d entries, but found %d", len(expected), result.Len())
+			}
+			for k, v := range expected {
+				if p := result.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+			if err := result.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if a.Len() != len(refA) || b.Len() != len(refB) {
+				t.Fatalf("expected the inputs to be unchanged")
+			}
+		})
+	}
+
+	// The result has the options and hash of the map, whichever input is
+	// smaller.
+	seeded := func(k uint64, shift uint32) uint32 { return hash(fmix64(k^0x9e3779b97f4a7c15), shift) }
+	a := newRobinHoodMapWithOptions(0, robinHoodOptions{shrinkBelow: 0.1})
+	a.Rekey(seeded)
+	b := newRobinHoodMap(0)
+	for k := uint64(0); k < 1000; k++ {
+		a.Put(k, unsafe.Pointer(new(int)))
+		if k%2 == 0 {
+			b.Put(k, unsafe.Pointer(new(int)))
+		}
+	}
+	for _, result := range []*robinHoodMap{a.Intersect(b), a.Intersect(newRobinHoodMap(0))} {
+		if result.opts.shrinkBelow != 0.1 {
+			t.Fatalf("expected shrinkBelow 0.1, but found %v", result.opts.shrinkBelow)
+		}
+		for i := range result.entries {
+			if e := &result.entries[i]; e.value != nil && result.hash(e.key) != seeded(e.key, result.shift) {
+				t.Fatalf("%d: expected the seeded hash", e.key)
+			}
+		}
+		if err := result.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobinHoodDeleteBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 12))
+		v := unsafe.Pointer(new(int))
+		m.Put(k, v)
+		ref[k] = v
+	}
+
+	// A mix of present and absent keys, including repeats.
+	keys := make([]uint64, 2000)
+	var expected int
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 12))
+		if _, ok := ref[keys[i]]; ok {
+			delete(ref, keys[i])
+			expected++
+		}
+	}
+	orig := append([]uint64(nil), keys...)
+
+	if removed := m.DeleteBatch(keys); removed != expected {
+		t.Fatalf("expected %d removed, but found %d", expected, removed)
+	}
+	for i := range keys {
+		if keys[i] != orig[i] {
+			t.Fatalf("expected keys to be unmodified")
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	for _, k := range keys {
+		if _, ok := ref[k]; !ok && m.Get(k) != nil {
+			t.Fatalf("%d: expected to be deleted", k)
+		}
+	}
+}
+
+func TestRobinHoodRemoveIf(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		t.Run(fmt.Sprintf("retain=%t", retain), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			m := newRobinHoodMap(0)
+			ref := make(map[uint64]unsafe.Pointer)
+			for i := 0; i < 1000; i++ {
+				k := uint64(rng.Intn(1 << 20))
+				v := unsafe.Pointer(new(int))
+				m.Put(k, v)
+				ref[k] = v
+			}
+
+			odd := func(k uint64, _ unsafe.Pointer) bool { return k%2 == 1 }
+			var expected int
+			for k := range ref {
+				if odd(k, nil) != retain {
+					delete(ref, k)
+					expected++
+				}
+			}
+
+			var removed int
+			if retain {
+				removed = m.RetainIf(odd)
+			} else {
+				removed = m.RemoveIf(odd)
+			}
+			if removed != expected {
+				t.Fatalf("expected %d removed, but found %d", expected, removed)
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+		})
+	}
+}
+
+func TestRobinHoodRangeMutate(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]int)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 12))
+		n := rng.Intn(4)
+		ref[k] = n
+		m.Put(k, unsafe.Pointer(&n))
+	}
+	for _, k := range collidingKeys(3) {
+		n := rng.Intn(2)
+		ref[k] = n
+		m.Put(k, unsafe.Pointer(&n))
+	}
+	s := m.Snapshot()
+	snapshot := make(map[uint64]int)
+	for k, n := range ref {
+		snapshot[k] = n
+	}
+
+	for round := 0; len(ref) > 0; round++ {
+		seen := make(map[uint64]bool)
+		m.RangeMutate(func(k uint64, v unsafe.Pointer) (unsafe.Pointer, bool) {
+			if seen[k] {
+				t.Fatalf("%d: visited twice", k)
+			}
+			seen[k] = true
+			n := *(*int)(v) - 1
+			return unsafe.Pointer(&n), n > 0
+		})
+		if len(seen) != len(ref) {
+			t.Fatalf("%d: expected %d entries visited, but found %d", round, len(ref), len(seen))
+		}
+		for k, n := range ref {
+			if n--; n > 0 {
+				ref[k] = n
+			} else {
+				delete(ref, k)
+			}
+		}
+
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != len(ref) {
+			t.Fatalf("%d: expected %d entries, but found %d", round, len(ref), m.Len())
+		}
+		for k, n := range ref {
+			if p := m.Get(k); p == nil || *(*int)(p) != n {
+				t.Fatalf("%d: %d: expected %d, but found %v", round, k, n, p)
+			}
+		}
+	}
+	if s.Len() != len(snapshot) {
+		t.Fatalf("expected %d entries in the snapshot, but found %d", len(snapshot), s.Len())
+	}
+	for k, n := range snapshot {
+		if p := s.Get(k); p == nil || *(*int)(p) != n {
+			t.Fatalf("%d: expected %d in the snapshot, but found %v", k, n, p)
+		}
+	}
+}
+
+func TestRobinHoodPopAny(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	if _, _, ok := m.PopAny(); ok {
+		t.Fatalf("expected empty map")
+	}
+
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 20))
+		v := unsafe.Pointer(new(int))
+		m.Put(k, v)
+		ref[k] = v
+	}
+
+	popped := make(map[uint64]bool)
+	for i := 0; ; i++ {
+		k, v, ok := m.PopAny()
+		if !ok {
+			break
+		}
+		if popped[k] {
+			t.Fatalf("%d: popped twice", k)
+		}
+		popped[k] = true
+		if ref[k] != v {
+			t.Fatalf("%d: expected %p, but found %p", k, ref[k], v)
+		}
+		// Interleave some inserts to exercise wrapping around the table.
+		if i%100 == 0 {
+			k := uint64(1<<20 + i)
+			v := unsafe.Pointer(new(int))
+			m.Put(k, v)
+			ref[k] = v
+		}
+	}
+	if len(popped) != len(ref) {
+		t.Fatalf("expected %d popped, but found %d", len(ref), len(popped))
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodPutBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+
+	var grows int
+	m.opts.onGrow = func(oldSize, newSize uint32) { grows++ }
+
+	keys := make([]uint64, 10000)
+	values := make([]unsafe.Pointer, len(keys))
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(5000))
+		values[i] = unsafe.Pointer(new(int))
+		ref[keys[i]] = values[i]
+	}
+	m.PutBatch(keys, values)
+
+	if grows > 1 {
+		t.Fatalf("expected at most 1 grow, but found %d", grows)
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodPutSlot(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 10))
+		v := unsafe.Pointer(new(int))
+		slot := m.PutSlot(k)
+		if old, ok := ref[k]; ok && *slot != old {
+			t.Fatalf("%d: expected existing value %p, but found %p", k, old, *slot)
+		}
+		*slot = v
+		ref[k] = v
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+
+	// Writing through the slot does not affect a snapshot.
+	k := uint64(1 << 20)
+	v := unsafe.Pointer(new(int))
+	m.Put(k, v)
+	s := m.Snapshot()
+	*m.PutSlot(k) = unsafe.Pointer(new(int))
+	if p := s.Get(k); p != v {
+		t.Fatalf("expected snapshot value %p, but found %p", v, p)
+	}
+}
+
+func TestRobinHoodTryPut(t *testing.T) {
+	keys := collidingKeys(5)
+	for _, shift := range []uint32{33, 48, 63} {
+		for _, k := range keys {
+			if h := hash(k, shift); h != 0 {
+				t.Fatalf("hash(%d, %d) = %d, expected 0", k, shift, h)
+			}
+		}
+	}
+
+	// With a fixed max distance, the colliding keys never fit no matter how much
+	// the table grows.
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+		maxDist: func(uint32) uint32 { return 4 },
+	})
+	v := unsafe.Pointer(new(int))
+	for _, k := range keys[:4] {
+		if err := m.TryPut(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, entries := m.size, append([]robinHoodEntry(nil), m.entries...)
+	if err := m.TryPut(keys[4], v); err == nil {
+		t.Fatalf("expected error")
+	}
+	if m.size != size || m.Len() != 4 {
+		t.Fatalf("expected size %d with 4 entries, but found size %d with %d entries", size, m.size, m.Len())
+	}
+	for i := range entries {
+		if entries[i] != m.entries[i] {
+			t.Fatalf("%d: expected %v, but found %v", i, entries[i], m.entries[i])
+		}
+	}
+
+	// Updating an existing key never needs to grow the table.
+	w := unsafe.Pointer(new(int))
+	if err := m.TryPut(keys[3], w); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.Get(keys[3]); p != w {
+		t.Fatalf("expected %p, but found %p", w, p)
+	}
+
+	// Ordinary keys grow the table as needed.
+	m = newRobinHoodMap(0)
+	for i := uint64(1); i <= 1000; i++ {
+		if err := m.TryPut(i*7919, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 1000; i++ {
+		if p := m.Get(i * 7919); p != v {
+			t.Fatalf("%d: expected %p, but found %p", i*7919, v, p)
+		}
+	}
+}
+
+func TestRobinHoodResizeTo(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 100; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+
+	testCases := []struct {
+		size     int
+		expected uint32
+	}{
+		{1 << 16, 1 << 16},
+		{1000, 1024},
+		{1025, 2048},
+		{200, 256},
+	}
+	for _, c := range testCases {
+		m.ResizeTo(c.size)
+		if m.size != c.expected {
+			t.Fatalf("%d: expected size %d, but found %d", c.size, c.expected, m.size)
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != len(ref) {
+			t.Fatalf("%d: expected %d entries, but found %d", c.size, len(ref), m.Len())
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: %d: expected %p, but found %p", c.size, k, v, p)
+			}
+		}
+	}
+
+	// A size equal to the count is accepted, though the table may grow further.
+	m.ResizeTo(m.Len())
+	if m.size < uint32(m.Len()) {
+		t.Fatalf("expected size of at least %d, but found %d", m.Len(), m.size)
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+
+	for _, size := range []int{m.Len() - 1, maxSize + 1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("%d: expected panic", size)
+				}
+			}()
+			m.ResizeTo(size)
+		}()
+	}
+
+	// An empty map shrinks to the smallest table.
+	e := newRobinHoodMap(1000)
+	e.ResizeTo(0)
+	if e.size != 2 {
+		t.Fatalf("expected size 2, but found %d", e.size)
+	}
+}
+
+func TestRobinHoodCompact(t *testing.T) {
+	for _, mix := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mix=%t", mix), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			m := newRobinHoodMapWithOptions(0, robinHoodOptions{mix: mix})
+			ref := make(map[uint64]unsafe.Pointer)
+			// Interleave inserts and deletes, leaving a small fraction of the peak
+			// count in a large table.
+			for i := 0; i < 20000; i++ {
+				k := uint64(rng.Int63())
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+				if i%4 != 0 {
+					for k := range ref {
+						m.Delete(k)
+						delete(ref, k)
+						break
+					}
+				}
+			}
+			for k := range ref {
+				if len(ref) <= 1000 {
+					break
+				}
+				m.Delete(k)
+				delete(ref, k)
+			}
+
+			size, maxDist, avgDist := m.size, m.MaxDist(), m.AvgDist()
+			m.Compact()
+			if m.size > size {
+				t.Fatalf("expected size of at most %d, but found %d", size, m.size)
+			}
+			if d := m.MaxDist(); d > maxDist {
+				t.Fatalf("expected max dist of at most %d, but found %d", maxDist, d)
+			}
+			if m.size == size && m.AvgDist() != avgDist {
+				t.Fatalf("expected avg dist %v to be unchanged, but found %v", avgDist, m.AvgDist())
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+
+			// Compacting again changes nothing.
+			entries := append([]robinHoodEntry(nil), m.entries...)
+			m.Compact()
+			if len(m.entries) != len(entries) {
+				t.Fatalf("expected %d entries, but found %d", len(entries), len(m.entries))
+			}
+			for i := range entries {
+				if entries[i] != m.entries[i] {
+					t.Fatalf("%d: expected %v, but found %v", i, entries[i], m.entries[i])
+				}
+			}
+		})
+	}
+
+	m := newRobinHoodMap(1000)
+	m.Compact()
+	if m.size != 2 {
+		t.Fatalf("expected size 2, but found %d", m.size)
+	}
+}
+
+func TestRobinHoodAdaptiveMaxDist(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{adaptiveMaxDist: true})
+	ref := make(map[uint64]unsafe.Pointer)
+	// A cluster longer than maxDist, inserted into a table of random keys
+	// with a low average distance, widens maxDist. The random keys which
+	// follow eventually grow the table, narrowing it again.
+	var keys []uint64
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, uint64(rng.Int63()))
+	}
+	keys = append(keys, clusteredKeys(rng, 1, 20)...)
+	for i := 0; i < 5000; i++ {
+		keys = append(keys, uint64(rng.Int63()))
+	}
+
+	var widened, narrowed int
+	for _, k := range keys {
+		size, maxDist := m.size, m.maxDist
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+		if m.maxDist == maxDist {
+			continue
+		}
+		if m.size == size {
+			widened++
+		} else if m.maxDist == m.maxDistForSize(m.size) {
+			narrowed++
+		}
+		// Every lookup is still correct after maxDist changes.
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+		}
+	}
+	if widened == 0 {
+		t.Fatalf("expected maxDist to widen without growing")
+	}
+	if narrowed == 0 {
+		t.Fatalf("expected maxDist to narrow when growing")
+	}
+	if limit := adaptiveMaxDistLimit * m.maxDistForSize(m.size); m.maxDist > limit {
+		t.Fatalf("expected maxDist of at most %d, but found %d", limit, m.maxDist)
+	}
+}
+
+func TestRobinHoodFreeze(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, 1000)
+	values := make([]unsafe.Pointer, len(keys))
+	for i := range keys {
+		keys[i] = uint64(rng.Int63())
+		values[i] = unsafe.Pointer(new(int))
+	}
+	m := newRobinHoodMap(0)
+	m.BulkLoad(keys, values)
+	// Reserving space larger than needed leaves room for Freeze to reclaim.
+	m.Reserve(10000)
+	size := m.size
+	m.Freeze()
+	if m.size >= size {
+		t.Fatalf("expected Freeze to shrink the table from %d, but found %d", size, m.size)
+	}
+	if max := m.MaxDist(); m.maxDist != max+1 {
+		t.Fatalf("expected maxDist %d, but found %d", max+1, m.maxDist)
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys which do not fit are rejected, leaving the map unchanged.
+	size = m.size
+	var rejected int
+	for i := 0; i < 10000 && rejected == 0; i++ {
+		k := uint64(rng.Int63())
+		if err := m.TryPut(k, unsafe.Pointer(new(int))); err != nil {
+			if !strings.Contains(err.Error(), "frozen") {
+				t.Fatalf("expected frozen error, but found %v", err)
+			}
+			if m.Get(k) != nil {
+				t.Fatalf("%d: expected rejected key to be absent", k)
+			}
+			rejected++
+		}
+	}
+	if rejected == 0 {
+		t.Fatalf("expected an insertion to be rejected")
+	}
+	if m.size != size {
+		t.Fatalf("expected size %d, but found %d", size, m.size)
+	}
+	for i, k := range keys {
+		if p := m.Get(k); p != values[i] {
+			t.Fatalf("%d: expected %p, but found %p", k, values[i], p)
+		}
+	}
+
+	// The frozen panic ends the write, so the same map is usable for every
+	// case, including in a maptoy_debug build.
+	for _, c := range []struct {
+		name string
+		f    func(m *robinHoodMap)
+	}{
+		{"reserve", func(m *robinHoodMap) { m.Reserve(100000) }},
+		{"resize", func(m *robinHoodMap) { m.ResizeTo(100000) }},
+		{"clear", func(m *robinHoodMap) { m.ClearWithCapacity(100000) }},
+		{"rekey", func(m *robinHoodMap) {
+			m.Rekey(func(k uint64, shift uint32) uint32 { return hash(fmix64(k), shift) })
+		}},
+		{"put", func(m *robinHoodMap) {
+			for _, k := range collidingKeys(int(m.maxDist) + 1) {
+				m.Put(k, unsafe.Pointer(new(int)))
+			}
+		}},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "frozen") {
+					t.Fatalf("%s: expected frozen panic, but found %v", c.name, r)
+				}
+			}()
+			c.f(m)
+		}()
+		// The count is checked against the occupied entries by checkInvariants.
+		for i, k := range keys {
+			if p := m.Get(k); p != values[i] {
+				t.Fatalf("%s: %d: expected %p, but found %p", c.name, k, values[i], p)
+			}
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestRobinHoodMaxLoad(t *testing.T) {
+	for _, ceiling := range []float64{-0.1, 1.5, math.NaN()} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("%v: expected panic", ceiling)
+				}
+			}()
+			newRobinHoodMapWithOptions(0, robinHoodOptions{maxLoad: ceiling})
+		}()
+	}
+
+	for _, ceiling := range []float64{0.5, 0.9} {
+		t.Run(fmt.Sprint(ceiling), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			var m *robinHoodMap
+			var grows int
+			m = newRobinHoodMapWithOptions(0, robinHoodOptions{
+				maxLoad: ceiling,
+				// A generous threshold leaves the load factor as the only trigger.
+				maxDist: func(size uint32) uint32 { return 64 },
+				onGrow: func(oldSize, newSize uint32) {
+					// The table grows exactly when one more entry would exceed the
+					// ceiling.
+					if limit := uint32(ceiling * float64(oldSize)); m.count != limit {
+						t.Fatalf("%d: expected growth at %d entries, but found %d", oldSize, limit, m.count)
+					}
+					if newSize != 2*oldSize {
+						t.Fatalf("expected growth to %d, but found %d", 2*oldSize, newSize)
+					}
+					grows++
+				},
+			})
+			ref := make(map[uint64]unsafe.Pointer)
+			for i := 0; i < 10000; i++ {
+				k := uint64(rng.Int63())
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+				if m.LoadFactor() > ceiling {
+					t.Fatalf("expected load factor at most %v, but found %v", ceiling, m.LoadFactor())
+				}
+			}
+			if grows == 0 {
+				t.Fatalf("expected the table to grow")
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+			// Replacing values does not count towards the ceiling.
+			size := m.size
+			for k := range ref {
+				m.Put(k, unsafe.Pointer(new(int)))
+			}
+			if m.size != size {
+				t.Fatalf("expected size %d, but found %d", size, m.size)
+			}
+		})
+	}
+}
+
+func TestRobinHoodMaxLoadInsertPaths(t *testing.T) {
+	// Every way of inserting an absent key honours the ceiling, so the tables
+	// end up the same size.
+	insert := map[string]func(m *robinHoodMap, k uint64, v unsafe.Pointer){
+		"Put": func(m *robinHoodMap, k uint64, v unsafe.Pointer) { m.Put(k, v) },
+		"GetOrCompute": func(m *robinHoodMap, k uint64, v unsafe.Pointer) {
+			m.GetOrCompute(k, func() unsafe.Pointer { return v })
+		},
+		"Swap": func(m *robinHoodMap, k uint64, v unsafe.Pointer) { m.Swap(k, v) },
+	}
+	for name, f := range insert {
+		t.Run(name, func(t *testing.T) {
+			m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+				maxLoad: 0.5,
+				maxDist: func(size uint32) uint32 { return 64 },
+			})
+			for k := uint64(0); k < 200; k++ {
+				if k == 128 && !m.NeedsGrow() {
+					t.Fatalf("expected NeedsGrow at %d entries in %d slots", m.Len(), m.size)
+				}
+				f(m, k, unsafe.Pointer(new(int)))
+				if m.LoadFactor() > 0.5 {
+					t.Fatalf("expected load factor at most 0.5, but found %v", m.LoadFactor())
+				}
+			}
+			if m.size != 512 {
+				t.Fatalf("expected size 512, but found %d", m.size)
+			}
+			if m.NeedsGrow() {
+				t.Fatalf("expected no NeedsGrow at %d entries in %d slots", m.Len(), m.size)
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			for k := uint64(0); k < 200; k++ {
+				if m.Get(k) == nil {
+					t.Fatalf("expected key %d to be present", k)
+				}
+			}
+		})
+	}
+}
+
+func TestRobinHoodFreezeRecoveredPut(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	m.Freeze()
+
+	// Each insertion either fits and is committed, or panics without having
+	// displaced any committed entry.
+	var panics int
+	inserts := []func(k uint64, v unsafe.Pointer){
+		func(k uint64, v unsafe.Pointer) { m.Put(k, v) },
+		func(k uint64, v unsafe.Pointer) { m.Swap(k, v) },
+		func(k uint64, v unsafe.Pointer) { m.GetOrCompute(k, func() unsafe.Pointer { return v }) },
+	}
+	for i := 0; i < 10000 && panics < 50; i++ {
+		k, v := uint64(rng.Int63()), unsafe.Pointer(new(int))
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					if !strings.Contains(fmt.Sprint(r), "frozen") {
+						t.Fatalf("expected frozen panic, but found %v", r)
+					}
+					panics++
+				}
+			}()
+			inserts[i%len(inserts)](k, v)
+			ref[k] = v
+		}()
+	}
+	if panics == 0 {
+		t.Fatalf("expected some insertions not to fit")
+	}
+
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodAutoShrink(t *testing.T) {
+	for _, mark := range []float64{-0.1, 1, math.NaN()} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("threshold %v: expected panic", mark)
+				}
+			}()
+			newRobinHoodMapWithOptions(0, robinHoodOptions{shrinkBelow: mark})
+		}()
+	}
+
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{shrinkBelow: 0.1})
+	keys := make([]uint64, 10000)
+	for i := range keys {
+		keys[i] = uint64(i) * 7919
+		m.Put(keys[i], unsafe.Pointer(new(int)))
+	}
+
+	// Deleting 90% of the entries crosses the threshold once. The shrunk table
+	// has a load factor well above the threshold.
+	var shrinks int
+	size := m.size
+	for _, k := range keys[1000:] {
+		m.Delete(k)
+		if m.size < size {
+			shrinks++
+			if lf := m.LoadFactor(); lf < 0.2 {
+				t.Fatalf("expected a load factor of at least 0.2, but found %.2f", lf)
+			}
+		} else if m.size > size {
+			t.Fatalf("expected no growth, but grew from %d to %d", size, m.size)
+		}
+		size = m.size
+	}
+	if shrinks != 1 {
+		t.Fatalf("expected 1 shrink, but found %d", shrinks)
+	}
+
+	// Inserting and deleting a key around the current count changes neither
+	// the size nor the entries.
+	for i := 0; i < 100; i++ {
+		m.Put(keys[0]+1, unsafe.Pointer(new(int)))
+		m.Delete(keys[0] + 1)
+	}
+	if m.size != size {
+		t.Fatalf("expected size %d, but found %d", size, m.size)
+	}
+	for _, k := range keys[:1000] {
+		if m.Get(k) == nil {
+			t.Fatalf("%d: expected present", k)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table is never shrunk below its size at construction.
+	m = newRobinHoodMapWithOptions(1000, robinHoodOptions{shrinkBelow: 0.1})
+	size = m.size
+	m.Put(1, unsafe.Pointer(new(int)))
+	m.Put(2, unsafe.Pointer(new(int)))
+	m.Delete(1)
+	m.LoadAndDelete(2)
+	if m.size != size {
+		t.Fatalf("expected size %d, but found %d", size, m.size)
+	}
+
+	// Every way of deleting entries shrinks the table.
+	remove := map[string]func(m *robinHoodMap){
+		"RemoveIf": func(m *robinHoodMap) {
+			m.RemoveIf(func(key uint64, value unsafe.Pointer) bool { return true })
+		},
+		"RetainIf": func(m *robinHoodMap) {
+			m.RetainIf(func(key uint64, value unsafe.Pointer) bool { return false })
+		},
+		"RangeMutate": func(m *robinHoodMap) {
+			m.RangeMutate(func(key uint64, value unsafe.Pointer) (unsafe.Pointer, bool) {
+				return nil, false
+			})
+		},
+		"PopAny": func(m *robinHoodMap) {
+			for _, _, ok := m.PopAny(); ok; _, _, ok = m.PopAny() {
+			}
+		},
+	}
+	for name, f := range remove {
+		m := newRobinHoodMapWithOptions(0, robinHoodOptions{shrinkBelow: 0.1})
+		for _, k := range keys {
+			m.Put(k, unsafe.Pointer(new(int)))
+		}
+		f(m)
+		if m.Len() != 0 {
+			t.Fatalf("%s: expected empty, but found %d entries", name, m.Len())
+		}
+		if m.size != m.minSize {
+			t.Fatalf("%s: expected size %d, but found %d", name, m.minSize, m.size)
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestRobinHoodClearWithCapacity(t *testing.T) {
+	testCases := []struct {
+		name     string
+		capacity int
+	}{
+		{"shrink", 10},
+		{"same", 1000},
+		{"grow", 100000},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			m := newRobinHoodMap(1000)
+			for i := 0; i < 1000; i++ {
+				m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+			}
+			size, ptr := m.size, m.entriesPtr
+			s := m.Snapshot()
+
+			m.ClearWithCapacity(c.capacity)
+			if m.Len() != 0 {
+				t.Fatalf("expected empty map, but found %d entries", m.Len())
+			}
+			if expected := sizeForCapacity(c.capacity); m.size != expected {
+				t.Fatalf("expected size %d, but found %d", expected, m.size)
+			}
+			if expected := int(m.size + m.maxDist); len(m.entries) != expected {
+				t.Fatalf("expected %d entries, but found %d", expected, len(m.entries))
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if c.capacity == 1000 && m.size != size {
+				t.Fatalf("expected size %d to be kept, but found %d", size, m.size)
+			}
+			if m.entriesPtr == ptr {
+				t.Fatalf("expected entries shared with the snapshot to be replaced")
+			}
+			if s.Len() != 1000 {
+				t.Fatalf("expected snapshot to keep 1000 entries, but found %d", s.Len())
+			}
+
+			// With no snapshot outstanding, clearing at the same size reuses the
+			// storage.
+			ref := make(map[uint64]unsafe.Pointer)
+			for i := 0; i < c.capacity; i++ {
+				k := uint64(rng.Int63())
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+			}
+			size, ptr = m.size, m.entriesPtr
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+			m.Clear()
+			if m.Len() != 0 || m.size != size || m.entriesPtr != ptr {
+				t.Fatalf("expected Clear to empty the map in place")
+			}
+			for k := range ref {
+				if p := m.Get(k); p != nil {
+					t.Fatalf("%d: expected nil, but found %p", k, p)
+				}
+			}
+			if err := m.checkInvariants(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRobinHoodPrewarm(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	for i := 0; i < 1000; i++ {
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+	}
+	entries := append([]robinHoodEntry(nil), m.entries...)
+	count := m.Len()
+
+	check := func() {
+		t.Helper()
+		if m.Len() != count {
+			t.Fatalf("expected %d entries, but found %d", count, m.Len())
+		}
+		for i := range entries {
+			if entries[i] != m.entries[i] {
+				t.Fatalf("%d: expected %v, but found %v", i, entries[i], m.entries[i])
+			}
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.Prewarm()
+	check()
+
+	s := m.Snapshot()
+	m.Prewarm()
+	check()
+	if !m.shared || s.Len() != count {
+		t.Fatalf("expected Prewarm to leave the snapshot shared")
+	}
+}
+
+func TestRobinHoodBulkLoad(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := uint64(0); i < 10; i++ {
+		v := unsafe.Pointer(new(int))
+		m.Put(i, v)
+		ref[i] = v
+	}
+
+	// The small key space guarantees duplicates within the batch and overlap
+	// with the existing entries.
+	keys := make([]uint64, 10000)
+	values := make([]unsafe.Pointer, len(keys))
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(5000))
+		values[i] = unsafe.Pointer(new(int))
+		ref[keys[i]] = values[i]
+	}
+	m.BulkLoad(keys, values)
+
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodGetOrCompute(t *testing.T) {
+	m := newRobinHoodMap(0)
+	calls := make(map[uint64]int)
+	values := make(map[uint64]unsafe.Pointer)
+	compute := func(k uint64) func() unsafe.Pointer {
+		return func() unsafe.Pointer {
+			calls[k]++
+			v := unsafe.Pointer(new(int))
+			values[k] = v
+			return v
+		}
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := uint64(1); i <= 1000; i++ {
+			k := i * 7919
+			v := m.GetOrCompute(k, compute(k))
+			if values[k] != v {
+				t.Fatalf("%d: expected %p, but found %p", k, values[k], v)
+			}
+			if calls[k] != 1 {
+				t.Fatalf("%d: expected 1 call to compute, but found %d", k, calls[k])
+			}
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys inserted with Put are never computed.
+	v := unsafe.Pointer(new(int))
+	m.Put(1, v)
+	if p := m.GetOrCompute(1, compute(1)); p != v || calls[1] != 0 {
+		t.Fatalf("expected %p without computing, but found %p after %d calls", v, p, calls[1])
+	}
+	if m.Len() != 1001 {
+		t.Fatalf("expected 1001 entries, but found %d", m.Len())
+	}
+
+	// A nil value panics before the map is modified, whether the key would
+	// be inserted in place or after growing the table.
+	for _, n := range []int{1, 3} {
+		m := newRobinHoodMapWithOptions(16, robinHoodOptions{
+			maxDist: func(size uint32) uint32 { return 3 },
+		})
+		keys := keysWithHash(m.shift, 0, n+1)
+		for _, k := range keys[:n] {
+			m.Put(k, v)
+		}
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "nil value") {
+					t.Fatalf("%d: expected nil value panic, but found %v", n, r)
+				}
+			}()
+			m.GetOrCompute(keys[n], func() unsafe.Pointer { return nil })
+		}()
+		if m.Len() != n {
+			t.Fatalf("%d: expected %d entries, but found %d", n, n, m.Len())
+		}
+		// The map is still usable, including by the write checks of debug
+		// builds.
+		m.Put(keys[n], v)
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobinHoodProbeHook(t *testing.T) {
+	type probe struct {
+		op   OpKind
+		dist uint32
+	}
+	var probes []probe
+	m := newRobinHoodMapWithOptions(8, robinHoodOptions{
+		onProbe: func(op OpKind, dist uint32) {
+			probes = append(probes, probe{op, dist})
+		},
+	})
+
+	// Build a chain of 3 keys starting at slot 3, followed by a key in slot 6.
+	keys := keysWithHash(m.shift, 3, 4)
+	other := keysWithHash(m.shift, 6, 1)[0]
+	v := unsafe.Pointer(new(int))
+	for _, k := range keys[:3] {
+		m.Put(k, v)
+	}
+	m.Put(other, v)
+	m.Put(keys[1], v)
+	m.Get(keys[0])
+	m.Get(keys[2])
+	m.Get(other)
+	// A miss walks past the chain and stops at the key in slot 6, which is
+	// richer than the missing key would be.
+	m.Get(keys[3])
+	// After deleting from the chain, the miss stops at the now empty slot 5.
+	m.Delete(keys[1])
+	m.Delete(keys[3])
+
+	expected := []probe{
+		{OpPut, 0}, {OpPut, 1}, {OpPut, 2}, {OpPut, 0}, {OpPut, 1},
+		{OpGet, 0}, {OpGet, 2}, {OpGet, 0}, {OpGet, 3},
+		{OpDelete, 1}, {OpDelete, 2},
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(probes) {
+		t.Fatalf("expected %v, but found %v", expected, probes)
+	}
+}
+
+func TestRobinHoodPutDist(t *testing.T) {
+	m := newRobinHoodMap(8)
+	chain := keysWithHash(m.shift, 3, 4)
+	other := keysWithHash(m.shift, 4, 1)[0]
+	v := unsafe.Pointer(new(int))
+
+	steps := []struct {
+		key  uint64
+		dist uint32
+	}{
+		{chain[0], 0},
+		{chain[1], 1},
+		{chain[2], 2},
+		// An update reports the existing distance.
+		{chain[1], 1},
+		// The key desiring slot 4 lands after the chain in slot 6.
+		{other, 2},
+		// The next key in the chain displaces it to slot 7.
+		{chain[3], 3},
+		{other, 3},
+	}
+	for i, s := range steps {
+		if dist := m.PutDist(s.key, v); dist != s.dist {
+			t.Fatalf("%d: expected dist %d for key %d, but found %d", i, s.dist, s.key, dist)
+		}
+	}
+
+	// Growing the table mid-insertion moves the entry.
+	m = newRobinHoodMap(0)
+	for i := uint64(1); i <= 1000; i++ {
+		k := i * 7919
+		if dist := m.PutDist(k, v); dist != m.find(k).dist {
+			t.Fatalf("%d: expected dist %d, but found %d", k, m.find(k).dist, dist)
+		}
+	}
+}
+
+func TestRobinHoodSlotInfo(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	keys := collidingKeys(3)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, uint64(rng.Int63()))
+	}
+	for _, k := range keys {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+
+	for _, k := range keys {
+		desired, actual, dist, ok := m.SlotInfo(k)
+		if !ok {
+			t.Fatalf("%d: expected to be present", k)
+		}
+		if desired != m.hash(k) {
+			t.Fatalf("%d: expected desired slot %d, but found %d", k, m.hash(k), desired)
+		}
+		if actual != desired+dist {
+			t.Fatalf("%d: expected actual slot %d+%d, but found %d", k, desired, dist, actual)
+		}
+		if e := &m.entries[actual]; e.key != k || e.dist != dist {
+			t.Fatalf("%d: expected entry at slot %d, but found [%d,%v,%d]", k, actual, e.key, e.value, e.dist)
+		}
+	}
+	// The colliding keys occupy consecutive slots from their shared desired
+	// slot.
+	for i, k := range keys[:3] {
+		if _, _, dist, _ := m.SlotInfo(k); dist != uint32(i) {
+			t.Fatalf("%d: expected dist %d, but found %d", k, i, dist)
+		}
+	}
+
+	m.Delete(keys[0])
+	if desired, _, _, ok := m.SlotInfo(keys[0]); ok || desired != m.hash(keys[0]) {
+		t.Fatalf("%d: expected absent key with desired slot %d", keys[0], m.hash(keys[0]))
+	}
+}
+
+func TestRobinHoodGetKnown(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	// Include the zero key, which matches the key of empty slots.
+	for _, k := range append(collidingKeys(3), 0) {
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	for k, v := range ref {
+		if p := m.GetKnown(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+}
+
+func TestRobinHoodContains(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	var present, absent []uint64
+	for _, k := range collidingKeys(6) {
+		if len(present) < 3 {
+			present = append(present, k)
+		} else {
+			absent = append(absent, k)
+		}
+	}
+	present = append(present, 0)
+	for i := 0; i < 1000; i++ {
+		present = append(present, uint64(rng.Int63()))
+	}
+	for _, k := range present {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	for len(absent) < 1000 {
+		if k := uint64(rng.Int63()); m.Get(k) == nil {
+			absent = append(absent, k)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		keys     []uint64
+		all, any bool
+	}{
+		{"empty", nil, true, false},
+		{"present", present, true, true},
+		{"absent", absent, false, false},
+		{"present-first", append([]uint64{present[0]}, absent...), false, true},
+		{"present-last", append(append([]uint64(nil), absent...), present[1]), false, true},
+		{"absent-last", append(append([]uint64(nil), present...), absent[0]), false, true},
+		{"one-present", present[2:3], true, true},
+		{"one-absent", absent[3:4], false, false},
+	}
+	for _, c := range testCases {
+		if all := m.ContainsAll(c.keys); all != c.all {
+			t.Fatalf("%s: expected ContainsAll %t, but found %t", c.name, c.all, all)
+		}
+		if any := m.ContainsAny(c.keys); any != c.any {
+			t.Fatalf("%s: expected ContainsAny %t, but found %t", c.name, c.any, any)
+		}
+	}
+}
+
+func TestRobinHoodGetMany(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	var keys []uint64
+	for _, k := range append(collidingKeys(3), 0) {
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+		keys = append(keys, k)
+	}
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 16))
+		if rng.Intn(2) == 0 {
+			ref[k] = unsafe.Pointer(new(int))
+			m.Put(k, ref[k])
+		}
+		// Absent keys and duplicates are both passed to GetMany.
+		keys = append(keys, k, k)
+	}
+	keys = append(keys, collidingKeys(4)[3])
+
+	found := m.GetMany(keys)
+	if len(found) != len(ref) {
+		t.Fatalf("expected %d keys, but found %d", len(ref), len(found))
+	}
+	for k, v := range ref {
+		if p, ok := found[k]; !ok || p != v {
+			t.Fatalf("%d: expected (%p,true), but found (%p,%t)", k, v, p, ok)
+		}
+	}
+	if found := m.GetMany(nil); len(found) != 0 {
+		t.Fatalf("expected no keys, but found %d", len(found))
+	}
+}
+
+func TestRobinHoodKeysForValue(t *testing.T) {
+	m := newRobinHoodMap(0)
+	a := unsafe.Pointer(new(int))
+	b := unsafe.Pointer(new(int))
+	// A value created separately but with the same contents as a is a
+	// different pointer.
+	c := unsafe.Pointer(new(int))
+	expected := map[unsafe.Pointer][]uint64{a: {0, 3, 7, 100}, b: {1, 2}, c: {5}}
+	for v, keys := range expected {
+		for _, k := range keys {
+			m.Put(k, v)
+		}
+	}
+	// Overwriting a key moves it to a different value.
+	m.Put(4, a)
+	m.Put(4, b)
+	expected[b] = append(expected[b], 4)
+
+	for v, keys := range expected {
+		found := m.KeysForValue(v)
+		sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+		if fmt.Sprint(found) != fmt.Sprint(keys) {
+			t.Fatalf("%p: expected %v, but found %v", v, keys, found)
+		}
+	}
+	for _, v := range []unsafe.Pointer{nil, unsafe.Pointer(new(int))} {
+		if found := m.KeysForValue(v); len(found) != 0 {
+			t.Fatalf("%p: expected no keys, but found %v", v, found)
+		}
+	}
+}
+
+func TestRobinHoodGetBounded(t *testing.T) {
+	m := newRobinHoodMap(0)
+	keys := collidingKeys(int(m.maxDist) - 1)
+	values := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		values[i] = unsafe.Pointer(new(int))
+		m.Put(k, values[i])
+	}
+	// A missing key which shares the desired slot of the chain.
+	missing := collidingKeys(len(keys) + 1)[len(keys)]
+
+	for i, k := range keys {
+		// The key at distance i is found on the (i+1)th probe.
+		if p, found, gaveUp := m.GetBounded(k, uint32(i)); p != nil || found || !gaveUp {
+			t.Fatalf("%d: expected to give up, but found (%p,%t,%t)", k, p, found, gaveUp)
+		}
+		if p, found, gaveUp := m.GetBounded(k, uint32(i+1)); p != values[i] || !found || gaveUp {
+			t.Fatalf("%d: expected (%p,true,false), but found (%p,%t,%t)", k, values[i], p, found, gaveUp)
+		}
+	}
+	n := uint32(len(m.ProbeSequence(missing)))
+	if _, found, gaveUp := m.GetBounded(missing, n-1); found || !gaveUp {
+		t.Fatalf("expected to give up, but found (%t,%t)", found, gaveUp)
+	}
+	if _, found, gaveUp := m.GetBounded(missing, n); found || gaveUp {
+		t.Fatalf("expected (false,false), but found (%t,%t)", found, gaveUp)
+	}
+
+	// A budget of MaxDist()+2 always resolves.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m = newRobinHoodMap(0)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	budget := m.MaxDist() + 2
+	for k, v := range ref {
+		if p, found, gaveUp := m.GetBounded(k, budget); p != v || !found || gaveUp {
+			t.Fatalf("%d: expected (%p,true,false), but found (%p,%t,%t)", k, v, p, found, gaveUp)
+		}
+		if _, found, gaveUp := m.GetBounded(k+1, budget); gaveUp || found != (ref[k+1] != nil) {
+			t.Fatalf("%d: expected to resolve, but found (%t,%t)", k+1, found, gaveUp)
+		}
+	}
+}
+
+func TestRobinHoodProbeSequence(t *testing.T) {
+	// A chain of 3 keys desiring slot 0, followed by a key at its desired
+	// slot 3 and one desiring slot 3 displaced to slot 4:
+	//
+	//   slot:  0   1   2   3   4   5
+	//   key:   a0  a1  a2  b0  b1  -
+	//   dist:  0   1   2   0   1
+	m := newRobinHoodMap(16)
+	a := collidingKeys(4)
+	b := keysWithHash(m.shift, 3, 3)
+	for _, k := range append(a[:3:3], b[:2]...) {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	testCases := []struct {
+		key      uint64
+		expected []uint32
+	}{
+		{a[0], []uint32{0}},
+		{a[2], []uint32{0, 1, 2}},
+		{b[0], []uint32{3}},
+		{b[1], []uint32{3, 4}},
+		// A missing colliding key walks the chain and stops at b0, which is
+		// richer than the probe at dist 3.
+		{a[3], []uint32{0, 1, 2, 3}},
+		// A missing key desiring slot 3 stops at the empty slot 5.
+		{b[2], []uint32{3, 4, 5}},
+	}
+	for _, c := range testCases {
+		if seq := m.ProbeSequence(c.key); fmt.Sprint(seq) != fmt.Sprint(c.expected) {
+			t.Fatalf("%d: expected %v, but found %v", c.key, c.expected, seq)
+		}
+	}
+}
+
+func TestRobinHoodPeek(t *testing.T) {
+	var probes int
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{
+		onProbe: func(OpKind, uint32) { probes++ },
+	})
+	keys := collidingKeys(3)
+	values := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		values[i] = unsafe.Pointer(new(int))
+		m.Put(k, values[i])
+	}
+	probes = 0
+
+	for i, k := range keys {
+		v, dist, ok := m.Peek(k)
+		if !ok || v != values[i] || dist != uint32(i) {
+			t.Fatalf("%d: expected (%p,%d,true), but found (%p,%d,%t)", k, values[i], i, v, dist, ok)
+		}
+	}
+	// The miss walks past the 3 colliding entries.
+	miss := collidingKeys(4)[3]
+	if v, dist, ok := m.Peek(miss); ok || v != nil || dist != 3 {
+		t.Fatalf("%d: expected (nil,3,false), but found (%p,%d,%t)", miss, v, dist, ok)
+	}
+	// The zero key matches the zero key of empty slots only if present.
+	if _, _, ok := m.Peek(0); ok {
+		t.Fatalf("expected the zero key to be absent")
+	}
+	if probes != 0 {
+		t.Fatalf("expected no probe hook calls, but found %d", probes)
+	}
+}
+
+func TestRobinHoodGrowHook(t *testing.T) {
+	type transition struct {
+		oldSize, newSize uint32
+	}
+	var grows []transition
+	opts := robinHoodOptions{
+		onGrow: func(oldSize, newSize uint32) {
+			grows = append(grows, transition{oldSize, newSize})
+		},
+	}
+
+	for _, tryPut := range []bool{false, true} {
+		grows = nil
+		m := newRobinHoodMapWithOptions(0, opts)
+		if len(grows) != 0 {
+			t.Fatalf("expected no grows on construction, but found %v", grows)
+		}
+		initial := m.size
+		v := unsafe.Pointer(new(int))
+		for i := uint64(1); i <= 1000; i++ {
+			if tryPut {
+				if err := m.TryPut(i*7919, v); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				m.Put(i*7919, v)
+			}
+		}
+
+		if len(grows) < 3 {
+			t.Fatalf("expected several grows, but found %v", grows)
+		}
+		size := initial
+		for _, g := range grows {
+			if g.oldSize != size || g.newSize != 2*size {
+				t.Fatalf("expected %d -> %d transition, but found %v", size, 2*size, grows)
+			}
+			size = g.newSize
+		}
+		if size != m.size {
+			t.Fatalf("expected final size %d, but found %d", m.size, size)
+		}
+	}
+}
+
+func TestRobinHoodCompareAndSwap(t *testing.T) {
+	m := newRobinHoodMap(0)
+	a := unsafe.Pointer(new(int))
+	b := unsafe.Pointer(new(int))
+	m.Put(1, a)
+
+	if !m.CompareAndSwap(1, a, b) {
+		t.Fatalf("expected swap to succeed")
+	}
+	if p := m.Get(1); p != b {
+		t.Fatalf("expected %p, but found %p", b, p)
+	}
+
+	if m.CompareAndSwap(1, a, a) {
+		t.Fatalf("expected swap to fail on value mismatch")
+	}
+	if p := m.Get(1); p != b {
+		t.Fatalf("expected %p, but found %p", b, p)
+	}
+
+	for _, old := range []unsafe.Pointer{nil, a} {
+		if m.CompareAndSwap(2, old, a) {
+			t.Fatalf("expected swap to fail on missing key")
+		}
+	}
+	if p := m.Get(2); p != nil {
+		t.Fatalf("expected missing key, but found %p", p)
+	}
+	if m.count != 1 {
+		t.Fatalf("expected count 1, but found %d", m.count)
+	}
+
+	// A nil new value is rejected, leaving the entry intact.
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "nil value") {
+				t.Fatalf("expected nil value panic, but found %v", r)
+			}
+		}()
+		m.CompareAndSwap(1, b, nil)
+	}()
+	if p := m.Get(1); p != b {
+		t.Fatalf("expected %p, but found %p", b, p)
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodSwap(t *testing.T) {
+	m := newRobinHoodMap(0)
+	keys := collidingKeys(3)
+	values := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		values[i] = unsafe.Pointer(new(int))
+		if old, loaded := m.Swap(k, values[i]); loaded || old != nil {
+			t.Fatalf("%d: expected (nil,false), but found (%p,%t)", k, old, loaded)
+		}
+	}
+	if m.Len() != len(keys) {
+		t.Fatalf("expected %d entries, but found %d", len(keys), m.Len())
+	}
+
+	for i, k := range keys {
+		v := unsafe.Pointer(new(int))
+		if old, loaded := m.Swap(k, v); !loaded || old != values[i] {
+			t.Fatalf("%d: expected (%p,true), but found (%p,%t)", k, values[i], old, loaded)
+		}
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	if m.Len() != len(keys) {
+		t.Fatalf("expected %d entries, but found %d", len(keys), m.Len())
+	}
+
+	// Swapping in keys which collide beyond maxDist grows the table.
+	many := collidingKeys(int(m.maxDist) + 1)
+	size := m.size
+	for _, k := range many[len(keys):] {
+		m.Swap(k, unsafe.Pointer(new(int)))
+	}
+	if m.size == size {
+		t.Fatalf("expected the table to grow from %d", size)
+	}
+	if m.Len() != len(many) {
+		t.Fatalf("expected %d entries, but found %d", len(many), m.Len())
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRobinHoodLoadAndDelete(t *testing.T) {
+	m := newRobinHoodMap(8)
+	keys := keysWithHash(m.shift, 3, 4)
+	values := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		values[i] = unsafe.Pointer(new(int))
+		m.Put(k, values[i])
+	}
+
+	// The last key sits at the end of the chain.
+	if e := m.entry(3 + 3); e.key != keys[3] || e.dist != 3 {
+		t.Fatalf("expected key %d at dist 3, but found [%d,%d]", keys[3], e.key, e.dist)
+	}
+	if v, ok := m.LoadAndDelete(keys[3]); !ok || v != values[3] {
+		t.Fatalf("expected (%p,true), but found (%p,%t)", values[3], v, ok)
+	}
+	if v, ok := m.LoadAndDelete(keys[3]); ok || v != nil {
+		t.Fatalf("expected (nil,false), but found (%p,%t)", v, ok)
+	}
+
+	// Remove the head of the chain, shifting the remaining entries backwards.
+	if v, ok := m.LoadAndDelete(keys[0]); !ok || v != values[0] {
+		t.Fatalf("expected (%p,true), but found (%p,%t)", values[0], v, ok)
+	}
+	for i := 1; i < 3; i++ {
+		if p := m.Get(keys[i]); p != values[i] {
+			t.Fatalf("%d: expected %p, but found %p", keys[i], values[i], p)
+		}
+	}
+	if v, ok := m.LoadAndDelete(0); ok || v != nil {
+		t.Fatalf("expected (nil,false), but found (%p,%t)", v, ok)
+	}
+	if m.count != 2 {
+		t.Fatalf("expected count 2, but found %d", m.count)
+	}
+}
+
+func TestRobinHoodHashMix(t *testing.T) {
+	m := newRobinHoodMapWithOptions(0, robinHoodOptions{mix: true})
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := uint64(0); i < 10000; i++ {
+		ref[i] = unsafe.Pointer(new(int))
+		m.Put(i, ref[i])
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+		if k%2 == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		}
+	}
+	if err := m.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+
+	// Without mixing, k and k|1 hash to the same slot.
+	if h := hash(2, m.shift); h != hash(3, m.shift) {
+		t.Fatalf("expected 2 and 3 to collide, but found %d and %d", h, hash(3, m.shift))
+	}
+	if m.hash(2) == m.hash(3) {
+		t.Fatalf("expected mixing to separate 2 and 3")
+	}
+}
+
+func TestRobinHoodRekey(t *testing.T) {
+	seeded := func(seed uint64) func(k uint64, shift uint32) uint32 {
+		return func(k uint64, shift uint32) uint32 { return hash(fmix64(k^seed), shift) }
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	m := newRobinHoodMap(0)
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-		v := new(int)
-		*v = i
-		m.Put(keys[i], unsafe.Pointer(v))
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
 	}
 
-	fmt.Printf("%s\n", m)
-	for i := range keys {
-		fmt.Println(m.Get(keys[i]))
+	for _, seed := range []uint64{0x9e3779b97f4a7c15, 0xc2b2ae3d27d4eb4f} {
+		h := seeded(seed)
+		m.Rekey(h)
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != len(ref) {
+			t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+		}
+		for k, v := range ref {
+			if p := m.Get(k); p != v {
+				t.Fatalf("%d: expected %p, but found %p", k, v, p)
+			}
+			if d := m.hash(k); d != h(k, m.shift) {
+				t.Fatalf("%d: expected desired slot %d, but found %d", k, h(k, m.shift), d)
+			}
+		}
+
+		// Mutations after rekeying use the new hash.
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+		for k := range ref {
+			m.Delete(k)
+			delete(ref, k)
+			break
+		}
+		if err := m.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobinHoodHashQuality(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	const size = 1 << 12
+	seen := make(map[uint64]bool)
+	keys := make([]uint64, 0, size/2)
+	for len(keys) < cap(keys) {
+		if k := uint64(rng.Int63()); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
 	}
 
-	for i := range keys {
-		m.Delete(keys[i])
-		fmt.Printf("%s\n", m)
+	// The simulation matches a real table of the same size which never grows.
+	m := newRobinHoodMapWithOptions(len(keys), robinHoodOptions{
+		maxDist: func(uint32) uint32 { return size },
+	})
+	for _, k := range keys {
+		m.Put(k, unsafe.Pointer(m))
+	}
+	if m.size != size {
+		t.Fatalf("expected size %d, but found %d", size, m.size)
+	}
+	maxDist, avgDist := hashQuality(keys, size, hash)
+	if maxDist != m.MaxDist() || avgDist != m.AvgDist() {
+		t.Fatalf("expected (%d,%v), but found (%d,%v)", m.MaxDist(), m.AvgDist(), maxDist, avgDist)
+	}
+
+	// A constant hash places the keys in a single run.
+	constant := func(uint64, uint32) uint32 { return 0 }
+	badMax, badAvg := hashQuality(keys, size, constant)
+	if expected := uint32(len(keys) - 1); badMax != expected {
+		t.Fatalf("expected max dist %d, but found %d", expected, badMax)
+	}
+	if expected := float64(len(keys)-1) / 2; badAvg != expected {
+		t.Fatalf("expected avg dist %v, but found %v", expected, badAvg)
+	}
+	if maxDist >= badMax/10 || avgDist >= badAvg/10 {
+		t.Fatalf("expected the Fibonacci hash (%d,%v) to be far better than a constant hash (%d,%v)",
+			maxDist, avgDist, badMax, badAvg)
 	}
 }
 
-func BenchmarkHash(b *testing.B) {
+func TestRobinHoodRangeByDesiredSlot(t *testing.T) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
+	m := newRobinHoodMap(0)
+	// Clusters produce long runs of entries displaced from their desired
+	// slots.
+	for _, k := range append(clusteredKeys(rng, 20, 10), benchKeys(rng.Int63(), 5000, 0)...) {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	for i, k := range m.Keys() {
+		if i%3 == 0 {
+			m.Delete(k)
+		}
+	}
+
+	var n int
+	var prev uint32
+	m.RangeByDesiredSlot(func(k uint64, v unsafe.Pointer) {
+		if m.Get(k) != v {
+			t.Fatalf("%d: unexpected value %p", k, v)
+		}
+		if d := m.hash(k); d < prev {
+			t.Fatalf("%d: desired slot %d follows desired slot %d", k, d, prev)
+		} else {
+			prev = d
+		}
+		n++
+	})
+	if n != m.Len() {
+		t.Fatalf("expected %d entries, but found %d", m.Len(), n)
+	}
+}
+
+func TestRobinHoodRangeSlots(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	for i := 0; i < 1000; i++ {
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+	}
+
+	var next uint32
+	var occupied int
+	m.RangeSlots(func(slot uint32, key uint64, value unsafe.Pointer, dist uint32) bool {
+		if slot != next {
+			t.Fatalf("expected slot %d, but found %d", next, slot)
+		}
+		next++
+		e := &m.entries[slot]
+		if key != e.key || value != e.value || dist != e.dist {
+			t.Fatalf("%d: expected [%d,%v,%d], but found [%d,%v,%d]",
+				slot, e.key, e.value, e.dist, key, value, dist)
+		}
+		if value != nil {
+			occupied++
+			if d := slot - hash(key, m.shift); d != dist {
+				t.Fatalf("%d: expected dist %d, but found %d", slot, d, dist)
+			}
+		}
+		return true
+	})
+	if int(next) != len(m.entries) {
+		t.Fatalf("expected %d slots, but found %d", len(m.entries), next)
+	}
+	if occupied != m.Len() {
+		t.Fatalf("expected %d occupied slots, but found %d", m.Len(), occupied)
+	}
+
+	var n int
+	m.RangeSlots(func(uint32, uint64, unsafe.Pointer, uint32) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("expected iteration to stop after 3 slots, but found %d", n)
+	}
+}
+
+func TestRobinHoodConcurrentReaders(t *testing.T) {
+	if debugChecks {
+		t.Skip("RangeFrom records its generation in maptoy_debug builds")
+	}
+	// Readers never write to the map, so "go test -race" reports nothing.
+	m := newRobinHoodMap(0)
+	for k := uint64(0); k < 1000; k++ {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int
+			for cursor, done := uint32(0), false; !done; {
+				cursor, done = m.RangeFrom(cursor, 10, func(k uint64, v unsafe.Pointer) { n++ })
+			}
+			m.Range(func(k uint64, v unsafe.Pointer) bool {
+				if m.Get(k) != v {
+					t.Errorf("%d: unexpected value %p", k, v)
+				}
+				return true
+			})
+			if n != m.Len() {
+				t.Errorf("expected %d entries, but found %d", m.Len(), n)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRobinHoodRangeFrom(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	for i := 0; i < 1000; i++ {
+		m.Put(uint64(rng.Int63()), unsafe.Pointer(new(int)))
+	}
+	// Entries in the padding beyond size are visited too.
+	for _, k := range keysWithHash(m.shift, m.size-1, 3) {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+
+	for _, limit := range []int{1, 7, 100, m.Len(), m.Len() + 1} {
+		seen := make(map[uint64]bool)
+		var cursor uint32
+		var pages int
+		for done := false; !done; pages++ {
+			var n int
+			cursor, done = m.RangeFrom(cursor, limit, func(k uint64, v unsafe.Pointer) {
+				if seen[k] {
+					t.Fatalf("%d: duplicate key %d", limit, k)
+				}
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, p, v)
+				}
+				seen[k] = true
+				n++
+			})
+			if n > limit {
+				t.Fatalf("%d: expected at most %d entries, but found %d", limit, limit, n)
+			}
+			if !done && n != limit {
+				t.Fatalf("%d: expected a full page before the end, but found %d entries", limit, n)
+			}
+		}
+		if len(seen) != m.Len() {
+			t.Fatalf("%d: expected %d keys, but found %d", limit, m.Len(), len(seen))
+		}
+		if max := (m.Len()+limit-1)/limit + 1; pages > max {
+			t.Fatalf("%d: expected at most %d pages, but found %d", limit, max, pages)
+		}
+	}
+
+	if next, done := m.RangeFrom(uint32(len(m.entries)), 10, func(uint64, unsafe.Pointer) {
+		t.Fatalf("expected no entries past the end")
+	}); !done || next != uint32(len(m.entries)) {
+		t.Fatalf("expected (%d,true), but found (%d,%t)", len(m.entries), next, done)
+	}
+}
+
+func TestRobinHoodSorted(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMap(0)
+	values := make(map[uint64]unsafe.Pointer)
+	for len(values) < 1000 {
+		k := uint64(rng.Int63())
+		if _, ok := values[k]; ok {
+			continue
+		}
+		v := unsafe.Pointer(new(int))
+		values[k] = v
+		m.Put(k, v)
+	}
+	for k := range values {
+		if k%3 == 0 {
+			m.Delete(k)
+			delete(values, k)
+		}
+	}
+
+	keys := m.SortedKeys()
+	if len(keys) != len(values) {
+		t.Fatalf("expected %d keys, but found %d", len(values), len(keys))
 	}
+	for i, k := range keys {
+		if i > 0 && keys[i-1] >= k {
+			t.Fatalf("%d: keys not strictly increasing: %d >= %d", i, keys[i-1], k)
+		}
+		if _, ok := values[k]; !ok {
+			t.Fatalf("%d: unexpected key %d", i, k)
+		}
+	}
+
+	var n int
+	m.RangeSorted(func(k uint64, v unsafe.Pointer) bool {
+		if keys[n] != k {
+			t.Fatalf("%d: expected key %d, but found %d", n, keys[n], k)
+		}
+		if values[k] != v {
+			t.Fatalf("%d: unexpected value for key %d", n, k)
+		}
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("expected RangeSorted to stop after 10 entries, but found %d", n)
+	}
+}
+
+// FuzzRobinHood applies a sequence of operations to a robinHoodMap and mirrors
+// them against a Go map. Each operation is 2 bytes: an op byte selecting
+// Put, Delete or Get (and the value to Put), and a key byte. The small key
+// space ensures plenty of collisions and overwrites.
+func FuzzRobinHood(f *testing.F) {
+	f.Add([]byte{0, 1, 3, 2, 6, 3, 1, 2, 2, 2, 2, 3})
+	f.Add([]byte{0, 0, 1, 0, 1, 0, 2, 0})
+	f.Add([]byte{0, 1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6, 0, 7, 0, 8, 1, 1, 1, 3, 1, 5})
+
+	var values [4]unsafe.Pointer
+	for i := range values {
+		values[i] = unsafe.Pointer(new(int))
+	}
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		m := newRobinHoodMap(0)
+		ref := make(map[uint64]unsafe.Pointer)
+		for ; len(ops) >= 2; ops = ops[2:] {
+			op, k := ops[0], uint64(ops[1])
+			switch op % 3 {
+			case 0:
+				v := values[(op/3)%uint8(len(values))]
+				m.Put(k, v)
+				ref[k] = v
+			case 1:
+				m.Delete(k)
+				delete(ref, k)
+			case 2:
+				if p := m.Get(k); p != ref[k] {
+					t.Fatalf("%d: expected %p, but found %p", k, ref[k], p)
+				}
+			}
+
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%d: expected %p, but found %p", k, v, p)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkHash(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
 	b.ResetTimer()
 
 	var h uint32
@@ -73,11 +3830,7 @@ func BenchmarkHash(b *testing.B) {
 }
 
 func BenchmarkGoMapInsert(b *testing.B) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-	}
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
 	b.ResetTimer()
 
 	var m map[uint64]unsafe.Pointer
@@ -93,11 +3846,7 @@ func BenchmarkGoMapInsert(b *testing.B) {
 }
 
 func BenchmarkRobinHoodInsert(b *testing.B) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-	}
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
 	v := unsafe.Pointer(new(int))
 	b.ResetTimer()
 
@@ -113,14 +3862,215 @@ func BenchmarkRobinHoodInsert(b *testing.B) {
 	}
 }
 
-func BenchmarkGoMapLookupHit(b *testing.B) {
+func BenchmarkRobinHoodPutLoop(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 0)
+	values := make([]unsafe.Pointer, len(keys))
+	v := unsafe.Pointer(new(int))
+	for i := range values {
+		values[i] = v
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := newRobinHoodMap(0)
+		for j := range keys {
+			m.Put(keys[j], values[j])
+		}
+	}
+}
+
+func BenchmarkRobinHoodBulkLoad(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 0)
+	values := make([]unsafe.Pointer, len(keys))
+	v := unsafe.Pointer(new(int))
+	for i := range values {
+		values[i] = v
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := newRobinHoodMap(0)
+		m.BulkLoad(keys, values)
+	}
+}
+
+func BenchmarkRobinHoodPutBatch(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 0)
+	values := make([]unsafe.Pointer, len(keys))
+	v := unsafe.Pointer(new(int))
+	for i := range values {
+		values[i] = v
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := newRobinHoodMap(0)
+		m.PutBatch(keys, values)
+	}
+}
+
+func BenchmarkRobinHoodHashMix(b *testing.B) {
+	keySets := []struct {
+		name string
+		key  func(i uint64) uint64
+	}{
+		{"sequential", func(i uint64) uint64 { return i }},
+		{"stride=1024", func(i uint64) uint64 { return i << 10 }},
+		{"high-bits", func(i uint64) uint64 { return i << 40 }},
+	}
+	for _, keys := range keySets {
+		for _, mix := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/mix=%t", keys.name, mix), func(b *testing.B) {
+				var m *robinHoodMap
+				for i := 0; i < b.N; i++ {
+					m = newRobinHoodMapWithOptions(0, robinHoodOptions{mix: mix})
+					for j := uint64(0); j < benchSize; j++ {
+						m.Put(keys.key(j), unsafe.Pointer(m))
+					}
+				}
+				b.ReportMetric(m.AvgDist(), "avg-dist")
+				b.ReportMetric(float64(m.MaxDist()), "max-dist")
+				b.ReportMetric(float64(m.size), "size")
+			})
+		}
+	}
+}
+
+// BenchmarkRobinHoodAdaptiveMaxDist compares the rehashes needed to insert a
+// skewed key set, mostly random keys with a few clusters colliding at every
+// size, under the fixed and adaptive max distance policies.
+func BenchmarkRobinHoodAdaptiveMaxDist(b *testing.B) {
+	rng := rand.New(rand.NewSource(benchSeed(b)))
+	keys := append(benchKeys(rng.Int63(), benchSize/4, 0), clusteredKeys(rng, 64, 16)...)
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for _, adaptive := range []bool{false, true} {
+		b.Run(fmt.Sprintf("adaptive=%t", adaptive), func(b *testing.B) {
+			var m *robinHoodMap
+			var grows int
+			for i := 0; i < b.N; i++ {
+				m = newRobinHoodMapWithOptions(0, robinHoodOptions{
+					adaptiveMaxDist: adaptive,
+					onGrow:          func(oldSize, newSize uint32) { grows++ },
+				})
+				for _, k := range keys {
+					m.Put(k, unsafe.Pointer(m))
+				}
+			}
+			b.ReportMetric(float64(grows)/float64(b.N), "grows")
+			b.ReportMetric(float64(m.RehashWork()), "rehash-work")
+			b.ReportMetric(float64(m.size), "size")
+			b.ReportMetric(float64(m.maxDist), "max-dist")
+		})
+	}
+}
+
+func BenchmarkRobinHoodRehash(b *testing.B) {
+	orders := []struct {
+		name string
+		less func(a, b *robinHoodEntry) bool
+	}{
+		{"slot", nil},
+		{"dist", func(a, b *robinHoodEntry) bool { return a.dist > b.dist }},
+	}
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	m := make(map[uint64]unsafe.Pointer, len(keys))
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-		m[keys[i]] = nil
+	src := fullRobinHoodMap(rng, 1<<16)
+
+	for _, order := range orders {
+		b.Run(order.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m := &robinHoodMap{}
+				*m = *src
+				m.entries = append([]robinHoodEntry(nil), src.entries...)
+				b.StartTimer()
+				if order.less == nil {
+					m.rehash(2 * src.size)
+				} else {
+					rehashInOrder(m, 2*src.size, order.less)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRobinHoodRehashMaxDist(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	src := fullRobinHoodMap(rng, 1<<16)
+	maxDist := src.maxDist + 4
+
+	for _, inPlace := range []bool{false, true} {
+		b.Run(fmt.Sprintf("in-place=%t", inPlace), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m := &robinHoodMap{}
+				*m = *src
+				// Leave room in the capacity so the in-place path can reslice.
+				m.entries = make([]robinHoodEntry, len(src.entries), len(src.entries)+int(maxDist))
+				copy(m.entries, src.entries)
+				m.entriesPtr = unsafe.Pointer(&m.entries[0])
+				m.opts.maxDist = func(uint32) uint32 { return maxDist }
+				b.StartTimer()
+				if inPlace {
+					m.rehashInPlace(maxDist)
+				} else {
+					m.rehash(m.size)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRobinHoodGrowPeakMemory reports the entries storage live at the
+// peak of a grow, of a rehash at the same size and of an in-place change of
+// maxDist. rehash keeps the old entries live until the reinsertion completes,
+// so its peak is the old and new tables together, while rehashInPlace
+// reslicing within capacity holds only the one table.
+func BenchmarkRobinHoodGrowPeakMemory(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	src := fullRobinHoodMap(rng, 1<<16)
+	const extra = 4
+	entryBytes := int(unsafe.Sizeof(robinHoodEntry{}))
+
+	for _, c := range []struct {
+		name string
+		f    func(m *robinHoodMap)
+	}{
+		{"grow", func(m *robinHoodMap) { m.rehash(grownSize(m.size, defaultGrowth)) }},
+		{"rehash", func(m *robinHoodMap) { m.rehash(m.size) }},
+		{"in-place", func(m *robinHoodMap) { m.rehashInPlace(m.maxDist + extra) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var peak int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m := &robinHoodMap{}
+				*m = *src
+				// Leave room in the capacity so the in-place path can reslice.
+				m.entries = make([]robinHoodEntry, len(src.entries), len(src.entries)+extra)
+				copy(m.entries, src.entries)
+				m.entriesPtr = unsafe.Pointer(&m.entries[0])
+				before, ptr := cap(m.entries), m.entriesPtr
+				b.StartTimer()
+				c.f(m)
+				b.StopTimer()
+				// The old entries stay live until the new ones are filled, unless the
+				// storage was reused.
+				peak = before + cap(m.entries)
+				if m.entriesPtr == ptr {
+					peak = cap(m.entries)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(peak*entryBytes), "peak-bytes")
+		})
 	}
+}
+
+func BenchmarkGoMapLookupHit(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
+	m := benchGoMap(keys)
 	b.ResetTimer()
 
 	var p unsafe.Pointer
@@ -137,14 +4087,18 @@ func BenchmarkGoMapLookupHit(b *testing.B) {
 }
 
 func BenchmarkRobinHoodLookupHit(b *testing.B) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	m := newRobinHoodMap(len(keys))
-	v := unsafe.Pointer(new(int))
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-		m.Put(keys[i], v)
-	}
+	benchmarkRobinHoodLookupHit(b, benchSeed(b))
+}
+
+// BenchmarkRobinHoodLookupHitFixedSeed is BenchmarkRobinHoodLookupHit with a
+// key set which is the same on every run, regardless of -maptoy.seed.
+func BenchmarkRobinHoodLookupHitFixedSeed(b *testing.B) {
+	benchmarkRobinHoodLookupHit(b, 1)
+}
+
+func benchmarkRobinHoodLookupHit(b *testing.B, seed int64) {
+	keys := benchKeys(seed, benchSize, 1<<20)
+	m := benchRobinHoodMap(len(keys), keys)
 	// fmt.Printf("max: %d avg: %.1f\n", m.MaxDist(), m.AvgDist())
 	b.ResetTimer()
 
@@ -161,15 +4115,53 @@ func BenchmarkRobinHoodLookupHit(b *testing.B) {
 	}
 }
 
-func BenchmarkGoMapLookupMiss(b *testing.B) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	m := make(map[uint64]unsafe.Pointer, len(keys))
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-		m[keys[i]] = nil
-		keys[i] += 1 << 20
+func BenchmarkRobinHoodLookupKnown(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
+	m := benchRobinHoodMap(len(keys), keys)
+
+	for _, known := range []bool{false, true} {
+		b.Run(fmt.Sprintf("known=%t", known), func(b *testing.B) {
+			var p unsafe.Pointer
+			for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+				if j == len(keys) {
+					j = 0
+				}
+				if known {
+					p = m.GetKnown(keys[j])
+				} else {
+					p = m.Get(keys[j])
+				}
+			}
+
+			if testing.Verbose() {
+				fmt.Println(p)
+			}
+		})
+	}
+}
+
+// BenchmarkRobinHoodLookupSmall measures lookups in a cache-resident table,
+// where the cost is dominated by the instructions of the probe rather than by
+// memory latency.
+func BenchmarkRobinHoodLookupSmall(b *testing.B) {
+	keys := benchKeys(benchSeed(b), 64, 0)
+	m := benchRobinHoodMap(len(keys), keys)
+	b.ResetTimer()
+
+	var p unsafe.Pointer
+	for i := 0; i < b.N; i++ {
+		p = m.Get(keys[i&63])
 	}
+
+	if testing.Verbose() {
+		fmt.Println(p)
+	}
+}
+
+func BenchmarkGoMapLookupMiss(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
+	m := benchGoMap(keys)
+	keys = benchMissKeys(keys, 1<<20)
 	b.ResetTimer()
 
 	var p unsafe.Pointer
@@ -186,15 +4178,9 @@ func BenchmarkGoMapLookupMiss(b *testing.B) {
 }
 
 func BenchmarkRobinHoodLookupMiss(b *testing.B) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	keys := make([]uint64, benchSize)
-	m := newRobinHoodMap(len(keys))
-	v := unsafe.Pointer(new(int))
-	for i := range keys {
-		keys[i] = uint64(rng.Intn(1 << 20))
-		m.Put(keys[i], v)
-		keys[i] += 1 << 20
-	}
+	keys := benchKeys(benchSeed(b), benchSize, 1<<20)
+	m := benchRobinHoodMap(len(keys), keys)
+	keys = benchMissKeys(keys, 1<<20)
 	b.ResetTimer()
 
 	var p unsafe.Pointer
@@ -209,3 +4195,29 @@ func BenchmarkRobinHoodLookupMiss(b *testing.B) {
 		fmt.Println(p)
 	}
 }
+
+// BenchmarkRobinHoodRangeSparse measures iterating a large table holding few
+// entries, with and without the occupancy bitset.
+func BenchmarkRobinHoodRangeSparse(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize/64, 0)
+	for _, occupancy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("occupancy=%t", occupancy), func(b *testing.B) {
+			m := newRobinHoodMapWithOptions(benchSize, robinHoodOptions{occupancy: occupancy})
+			for _, k := range keys {
+				m.Put(k, unsafe.Pointer(m))
+			}
+			b.ResetTimer()
+
+			var n int
+			for i := 0; i < b.N; i++ {
+				m.Range(func(k uint64, v unsafe.Pointer) bool {
+					n++
+					return true
+				})
+			}
+			if n != b.N*len(keys) {
+				b.Fatalf("expected %d entries, but found %d", b.N*len(keys), n)
+			}
+		})
+	}
+}
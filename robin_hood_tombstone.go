@@ -0,0 +1,224 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// tombstoneValue is the value of an entry of a robinHoodMapTombstone which
+// has been deleted in tombstone mode.
+var tombstoneValue byte
+
+// tombstone marks a deleted entry. It is non-nil, so probes step over the
+// entry as they would a live one.
+var tombstone = unsafe.Pointer(&tombstoneValue)
+
+// robinHoodMapTombstone is a variant of robinHoodMap whose deletion mode is
+// chosen at construction. By default Delete uses backward shift deletion,
+// like robinHoodMap, which keeps probes short but moves the entries following
+// the deleted one. In tombstone mode, Delete instead replaces the value of
+// the entry with a tombstone which keeps its key and distance, so no other
+// entry moves: a reader scanning the table concurrently with a deletion
+// cannot miss a key because it shifted past the reader. Insertions still
+// displace entries. A tombstone continues to lengthen the probes passing
+// over it until it is reused by an insertion, the table grows, or Compact
+// removes it. See robinHoodMap for a description of the table layout.
+type robinHoodMapTombstone struct {
+	entries    []robinHoodEntry
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+	// tombstones selects tombstone mode.
+	tombstones bool
+	// dead is the number of tombstones in the table.
+	dead uint32
+}
+
+func newRobinHoodMapTombstone(initialCapacity int, tombstones bool) *robinHoodMapTombstone {
+	m := &robinHoodMapTombstone{tombstones: tombstones}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+// rehash moves the live entries to a table of the specified size, dropping
+// the tombstones.
+func (m *robinHoodMapTombstone) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntry, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+	m.dead = 0
+
+	for i := range oldEntries {
+		if e := &oldEntries[i]; e.value != nil && e.value != tombstone {
+			m.Put(e.key, e.value)
+		}
+	}
+}
+
+func (m *robinHoodMapTombstone) entry(i uint32) *robinHoodEntry {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntry)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntry{})))
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry. A tombstone for the key, or a tombstone the new entry
+// would otherwise displace, is overwritten in place.
+func (m *robinHoodMapTombstone) Put(k uint64, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	n := robinHoodEntry{key: k, value: v, dist: 0}
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry, or the tombstone of a deleted one, which is
+			// in the right position for the key.
+			if e.value == tombstone {
+				m.dead--
+				m.count++
+			}
+			e.value = n.value
+			return
+		}
+
+		if e.dist < n.dist {
+			if e.value == tombstone {
+				// The key is absent, and the slot of a rich tombstone is where it
+				// belongs: replacing the tombstone preserves the ordering of the
+				// chain just as displacing a live entry would.
+				*e = n
+				m.dead--
+				m.count++
+				return
+			}
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapTombstone) Get(k uint64) unsafe.Pointer {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			// Found the entry, or its tombstone.
+			if e.value == tombstone {
+				return nil
+			}
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present, either by
+// replacing its value with a tombstone or by shifting the following entries
+// backwards, depending on the mode of the map.
+func (m *robinHoodMapTombstone) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			if e.value == tombstone {
+				// Already deleted.
+				return
+			}
+			m.count--
+			if m.tombstones {
+				e.value = tombstone
+				m.dead++
+				return
+			}
+			// Shift the following entries backwards until the next empty entry or
+			// entry with a zero distance. Empty entries always have "dist == 0".
+			for j := i + 1; ; j++ {
+				t := m.entry(j)
+				if t.dist == 0 {
+					*e = robinHoodEntry{}
+					return
+				}
+				*e = *t
+				e.dist--
+				e = t
+			}
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// Compact removes every tombstone by rehashing the live entries at the
+// current size, returning the number of tombstones removed. Only the live
+// entries are placed, so no distance grows and the table never grows. Unlike
+// Delete in tombstone mode, it moves entries, and must not run concurrently
+// with readers.
+func (m *robinHoodMapTombstone) Compact() int {
+	dead := int(m.dead)
+	if dead > 0 {
+		m.rehash(m.size)
+	}
+	return dead
+}
+
+// Tombstones returns the number of tombstones in the table.
+func (m *robinHoodMapTombstone) Tombstones() int {
+	return int(m.dead)
+}
+
+// Len returns the number of entries in the map, not counting tombstones.
+func (m *robinHoodMapTombstone) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// slots returns the slot of every entry in the map, tombstones included.
+func (m *robinHoodMapTombstone) slots() map[uint64]int {
+	slots := make(map[uint64]int)
+	for i := range m.entries {
+		if e := &m.entries[i]; e.value != nil {
+			slots[e.key] = i
+		}
+	}
+	return slots
+}
+
+func TestRobinHoodTombstone(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%t", tombstones), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			m := newRobinHoodMapTombstone(0, tombstones)
+			ref := make(map[uint64]unsafe.Pointer)
+			for i := 0; i < 20000; i++ {
+				k := uint64(rng.Intn(4096))
+				if rng.Intn(3) == 0 {
+					m.Delete(k)
+					delete(ref, k)
+				} else {
+					ref[k] = unsafe.Pointer(new(int))
+					m.Put(k, ref[k])
+				}
+			}
+
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k := uint64(0); k < 4096; k++ {
+				if p := m.Get(k); p != ref[k] {
+					t.Fatalf("%d: expected %p, but found %p", k, ref[k], p)
+				}
+			}
+			var dead int
+			for i := range m.entries {
+				e := &m.entries[i]
+				if e.value == nil {
+					continue
+				}
+				if e.value == tombstone {
+					dead++
+				}
+				if d := hash(e.key, m.shift); uint32(i)-d != e.dist {
+					t.Fatalf("%d: key %d desires slot %d, but has dist %d", i, e.key, d, e.dist)
+				}
+			}
+			if !tombstones && dead != 0 {
+				t.Fatalf("expected no tombstones, but found %d", dead)
+			}
+			if dead != m.Tombstones() {
+				t.Fatalf("expected %d tombstones, but found %d", m.Tombstones(), dead)
+			}
+		})
+	}
+}
+
+func TestRobinHoodTombstoneStable(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapTombstone(0, true)
+	keys := append(clusteredKeys(rng, 20, 8), benchKeys(rng.Int63(), 2000, 0)...)
+	for _, k := range keys {
+		m.Put(k, unsafe.Pointer(new(int)))
+	}
+
+	// Deleting entries leaves every other entry where it was.
+	before := m.slots()
+	for i, k := range keys {
+		if i%2 == 0 {
+			m.Delete(k)
+		}
+	}
+	for k, slot := range m.slots() {
+		if before[k] != slot {
+			t.Fatalf("%d: expected slot %d, but found %d", k, before[k], slot)
+		}
+	}
+	if n := m.Tombstones(); n != len(before)-m.Len() {
+		t.Fatalf("expected %d tombstones, but found %d", len(before)-m.Len(), n)
+	}
+
+	// Reinserting a deleted key reuses its tombstone.
+	m.Put(keys[0], unsafe.Pointer(new(int)))
+	if slot := m.slots()[keys[0]]; slot != before[keys[0]] {
+		t.Fatalf("expected slot %d, but found %d", before[keys[0]], slot)
+	}
+	m.Delete(keys[0])
+}
+
+func TestRobinHoodTombstoneCompact(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapTombstone(0, true)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 5000; i++ {
+		k := uint64(rng.Int63())
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+	for k := range ref {
+		if rng.Intn(2) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+		}
+	}
+	dead := m.Tombstones()
+	if dead == 0 {
+		t.Fatalf("expected tombstones")
+	}
+
+	size := m.size
+	if n := m.Compact(); n != dead {
+		t.Fatalf("expected %d tombstones removed, but found %d", dead, n)
+	}
+	if m.Tombstones() != 0 || m.size != size {
+		t.Fatalf("expected no tombstones at size %d, but found %d at size %d", size, m.Tombstones(), m.size)
+	}
+	for i := range m.entries {
+		if m.entries[i].value == tombstone {
+			t.Fatalf("%d: expected no tombstone", i)
+		}
+	}
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	if n := m.Compact(); n != 0 {
+		t.Fatalf("expected nothing to compact, but found %d", n)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+type robinHoodEntryTTL struct {
+	key    uint64
+	value  unsafe.Pointer
+	expiry int64
+	dist   uint32
+}
+
+// robinHoodMapTTL is a variant of robinHoodMap for use as a cache, storing an
+// expiry time alongside each value. Times are opaque int64s supplied by the
+// caller, such as UnixNano timestamps. An entry expires once now reaches its
+// expiry, and an expiry of 0 never expires. Expired entries are removed
+// lazily by Get or in bulk by SweepExpired. See robinHoodMap for a
+// description of the table layout.
+type robinHoodMapTTL struct {
+	entries    []robinHoodEntryTTL
+	entriesPtr unsafe.Pointer
+	size       uint32
+	shift      uint32
+	count      uint32
+	maxDist    uint32
+}
+
+func newRobinHoodMapTTL(initialCapacity int) *robinHoodMapTTL {
+	m := &robinHoodMapTTL{}
+	m.rehash(sizeForCapacity(initialCapacity))
+	return m
+}
+
+func (m *robinHoodMapTTL) rehash(size uint32) {
+	oldEntries := m.entries
+	m.size = size
+	m.shift = uint32(64 - bits.Len32(m.size-1))
+	m.maxDist = maxDistForSize(size)
+	m.entries = make([]robinHoodEntryTTL, size+m.maxDist)
+	m.entriesPtr = unsafe.Pointer(&m.entries[0])
+	m.count = 0
+
+	for i := range oldEntries {
+		e := &oldEntries[i]
+		if e.value != nil {
+			m.Put(e.key, e.value, e.expiry)
+		}
+	}
+}
+
+func (m *robinHoodMapTTL) entry(i uint32) *robinHoodEntryTTL {
+	if safeChecks {
+		return &m.entries[i]
+	}
+	// Manually index into the entries array to avoid the bounds checking.
+	return (*robinHoodEntryTTL)(unsafe.Pointer(uintptr(m.entriesPtr) + uintptr(i)*unsafe.Sizeof(robinHoodEntryTTL{})))
+}
+
+func (e *robinHoodEntryTTL) expired(now int64) bool {
+	return e.expiry != 0 && now >= e.expiry
+}
+
+// Put inserts the entry for the specified key with the specified expiry,
+// replacing the value and expiry of an existing entry.
+func (m *robinHoodMapTTL) Put(k uint64, v unsafe.Pointer, expiry int64) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	n := robinHoodEntryTTL{key: k, value: v, expiry: expiry}
+	for i := hash(n.key, m.shift); ; i++ {
+		e := m.entry(i)
+		if e.value == nil {
+			// Found an empty entry: insert here.
+			*e = n
+			m.count++
+			return
+		}
+
+		if e.key == n.key {
+			// Found an existing entry.
+			e.value = n.value
+			e.expiry = n.expiry
+			return
+		}
+
+		if e.dist < n.dist {
+			// Swap the new entry with the current entry because the current is
+			// rich.
+			n, *e = *e, n
+		}
+
+		// The new entry gradually moves away from its ideal position.
+		n.dist++
+
+		// If we've reached the max distance threshold, grow the table and restart
+		// the insertion of the entry we're carrying.
+		if n.dist == m.maxDist {
+			m.rehash(grownSize(m.size, defaultGrowth))
+			i = hash(n.key, m.shift) - 1
+			n.dist = 0
+		}
+	}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present or has expired as of now. An expired entry is deleted.
+func (m *robinHoodMapTTL) Get(k uint64, now int64) unsafe.Pointer {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			if e.expired(now) {
+				m.removeAt(i)
+				return nil
+			}
+			return e.value
+		}
+		if dist > e.dist {
+			// Not found.
+			return nil
+		}
+		dist++
+	}
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapTTL) Delete(k uint64) {
+	var dist uint32
+	for i := hash(k, m.shift); ; i++ {
+		e := m.entry(i)
+		if k == e.key && e.value != nil {
+			m.removeAt(i)
+			return
+		}
+		if dist > e.dist {
+			// Not found.
+			return
+		}
+		dist++
+	}
+}
+
+// SweepExpired deletes every entry which has expired as of now, returning
+// the number of entries removed. Removing an entry shifts the following
+// entries backwards, so the scan examines the same slot again rather than
+// advancing. See robinHoodMap.removeWhere.
+func (m *robinHoodMapTTL) SweepExpired(now int64) int {
+	var removed int
+	for i := uint32(0); i < uint32(len(m.entries)); {
+		e := m.entry(i)
+		if e.value != nil && e.expired(now) {
+			m.removeAt(i)
+			removed++
+			continue
+		}
+		i++
+	}
+	return removed
+}
+
+// removeAt removes the entry at index i, shifting the following entries
+// backwards until the next empty entry or entry with a zero distance.
+func (m *robinHoodMapTTL) removeAt(i uint32) {
+	e := m.entry(i)
+	m.count--
+	for j := i + 1; ; j++ {
+		t := m.entry(j)
+		if t.dist == 0 {
+			*e = robinHoodEntryTTL{}
+			return
+		}
+		*e = *t
+		e.dist--
+		e = t
+	}
+}
+
+// Len returns the number of entries in the map, including expired entries
+// which have not yet been removed.
+func (m *robinHoodMapTTL) Len() int {
+	return int(m.count)
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodTTLLazyExpiry(t *testing.T) {
+	m := newRobinHoodMapTTL(0)
+	v := unsafe.Pointer(new(int))
+	m.Put(1, v, 10)
+	m.Put(2, v, 0)
+
+	if p := m.Get(1, 9); p != v {
+		t.Fatalf("expected %p before expiry, but found %p", v, p)
+	}
+	if m.Len() != 2 {
+		t.Fatalf("expected 2 entries, but found %d", m.Len())
+	}
+	if p := m.Get(1, 10); p != nil {
+		t.Fatalf("expected nil at expiry, but found %p", p)
+	}
+	if m.Len() != 1 {
+		t.Fatalf("expected expired entry to be deleted, but found %d entries", m.Len())
+	}
+	// Going back in time does not resurrect a deleted entry.
+	if p := m.Get(1, 0); p != nil {
+		t.Fatalf("expected nil, but found %p", p)
+	}
+	// An expiry of 0 never expires.
+	if p := m.Get(2, 1<<62); p != v {
+		t.Fatalf("expected %p, but found %p", v, p)
+	}
+
+	// Put replaces the expiry of an existing entry.
+	m.Put(2, v, 5)
+	if p := m.Get(2, 5); p != nil {
+		t.Fatalf("expected nil, but found %p", p)
+	}
+	if m.Len() != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+}
+
+func TestRobinHoodTTLSweep(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapTTL(0)
+	type entry struct {
+		value  unsafe.Pointer
+		expiry int64
+	}
+	ref := make(map[uint64]entry)
+	for i := 0; i < 10000; i++ {
+		k := uint64(rng.Intn(1 << 20))
+		e := entry{unsafe.Pointer(new(int)), int64(rng.Intn(100))}
+		m.Put(k, e.value, e.expiry)
+		ref[k] = e
+	}
+
+	for _, now := range []int64{0, 25, 50, 100} {
+		var expected int
+		for k, e := range ref {
+			if e.expiry != 0 && now >= e.expiry {
+				delete(ref, k)
+				expected++
+			}
+		}
+		if removed := m.SweepExpired(now); removed != expected {
+			t.Fatalf("%d: expected %d removed, but found %d", now, expected, removed)
+		}
+		if m.Len() != len(ref) {
+			t.Fatalf("%d: expected %d entries, but found %d", now, len(ref), m.Len())
+		}
+		for k, e := range ref {
+			if p := m.Get(k, now); p != e.value {
+				t.Fatalf("%d: %d: expected %p, but found %p", now, k, e.value, p)
+			}
+		}
+	}
+	// Only the entries which never expire survive.
+	for k, e := range ref {
+		if e.expiry != 0 {
+			t.Fatalf("%d: expected expiry 0, but found %d", k, e.expiry)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// robinHoodMapTwoLevel splits its keys across a fixed number of independent
+// robinHoodMaps by the high bits of the mixed key. Each sub-table grows on
+// its own, so there is never a single allocation of the backing array for
+// all of the entries, and a growth rehashes only one sub-table, bounding both
+// the largest allocation and the longest pause to roughly 1/len(tables) of
+// those of a single table.
+//
+// The sub-table is selected using fmix64 rather than the Fibonacci hash:
+// the sub-tables take their slots from the high bits of the Fibonacci
+// product, so if those bits also selected the sub-table, every key in a
+// sub-table would fall into a small fraction of its slots.
+type robinHoodMapTwoLevel struct {
+	tables []*robinHoodMap
+	// shift selects the sub-table from the high bits of the mixed key.
+	shift uint32
+}
+
+// newRobinHoodMapTwoLevel returns a map with 2^bits sub-tables which together
+// have room for initialCapacity entries. bits must be between 1 and 16.
+func newRobinHoodMapTwoLevel(initialCapacity int, bits uint) *robinHoodMapTwoLevel {
+	if bits < 1 || bits > 16 {
+		panic(fmt.Sprintf("robinHoodMap: invalid number of sub-table bits: %d", bits))
+	}
+	m := &robinHoodMapTwoLevel{
+		tables: make([]*robinHoodMap, 1<<bits),
+		shift:  uint32(64 - bits),
+	}
+	perTable := (initialCapacity + len(m.tables) - 1) / len(m.tables)
+	for i := range m.tables {
+		m.tables[i] = newRobinHoodMap(perTable)
+	}
+	return m
+}
+
+func (m *robinHoodMapTwoLevel) table(k uint64) *robinHoodMap {
+	return m.tables[fmix64(k)>>m.shift]
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry.
+func (m *robinHoodMapTwoLevel) Put(k uint64, v unsafe.Pointer) {
+	m.table(k).Put(k, v)
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *robinHoodMapTwoLevel) Get(k uint64) unsafe.Pointer {
+	return m.table(k).Get(k)
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *robinHoodMapTwoLevel) Delete(k uint64) {
+	m.table(k).Delete(k)
+}
+
+// Len returns the number of entries in the map.
+func (m *robinHoodMapTwoLevel) Len() int {
+	var n int
+	for _, t := range m.tables {
+		n += t.Len()
+	}
+	return n
+}
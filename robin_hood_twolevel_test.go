@@ -0,0 +1,90 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodTwoLevel(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapTwoLevel(0, 4)
+	ref := make(map[uint64]unsafe.Pointer)
+	for i := 0; i < 100000; i++ {
+		k := uint64(rng.Intn(1 << 16))
+		if rng.Intn(4) == 0 {
+			m.Delete(k)
+			delete(ref, k)
+			continue
+		}
+		ref[k] = unsafe.Pointer(new(int))
+		m.Put(k, ref[k])
+	}
+
+	if m.Len() != len(ref) {
+		t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+	}
+	for k, v := range ref {
+		if p := m.Get(k); p != v {
+			t.Fatalf("%d: expected %p, but found %p", k, v, p)
+		}
+	}
+	for k := uint64(1 << 16); k < 1<<17; k++ {
+		if p := m.Get(k); p != nil {
+			t.Fatalf("%d: expected nil, but found %p", k, p)
+		}
+	}
+
+	// The keys are spread across every sub-table, and each sub-table holds
+	// exactly the keys which map to it.
+	for i, sub := range m.tables {
+		if sub.Len() == 0 {
+			t.Fatalf("%d: expected a non-empty sub-table", i)
+		}
+		if err := sub.checkInvariants(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		sub.Range(func(k uint64, _ unsafe.Pointer) bool {
+			if m.table(k) != sub {
+				t.Fatalf("%d: key %d in the wrong sub-table", i, k)
+			}
+			return true
+		})
+	}
+}
+
+// BenchmarkRobinHoodTwoLevelInsertLatency compares the tail latency of
+// insertions into a growing map, where the two-level map only rehashes a
+// single sub-table at a time.
+func BenchmarkRobinHoodTwoLevelInsertLatency(b *testing.B) {
+	keys := benchKeys(benchSeed(b), benchSize, 0)
+	v := unsafe.Pointer(new(int))
+	b.Run("single", func(b *testing.B) {
+		benchInsertLatency(b, keys, func() func(uint64) {
+			m := newRobinHoodMap(0)
+			return func(k uint64) { m.Put(k, v) }
+		})
+	})
+	b.Run("two-level", func(b *testing.B) {
+		benchInsertLatency(b, keys, func() func(uint64) {
+			m := newRobinHoodMapTwoLevel(0, 6)
+			return func(k uint64) { m.Put(k, v) }
+		})
+	})
+}
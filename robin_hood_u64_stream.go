@@ -0,0 +1,117 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The stream format of a robinHoodMapU64 is a header of streamMagic followed
+// by the entry count as a little-endian uint64, and then that many pairs of
+// little-endian uint64 key and value. The entries are in slot order.
+const (
+	streamMagic      = "rhu64\x00\x00\x01"
+	streamHeaderSize = len(streamMagic) + 8
+	streamPairSize   = 16
+	// streamBatch is the number of pairs encoded or decoded per call to the
+	// underlying writer or reader, bounding the memory used by a stream of any
+	// size.
+	streamBatch = 256
+)
+
+// WriteTo writes the entries of the map to w in the stream format, returning
+// the number of bytes written. The entries are encoded in fixed-size batches,
+// so the memory used does not depend on the size of the map. The map must
+// not be mutated while it is being written.
+func (m *robinHoodMapU64) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	buf := make([]byte, 0, streamBatch*streamPairSize)
+	flush := func() error {
+		n, err := w.Write(buf)
+		written += int64(n)
+		buf = buf[:0]
+		return err
+	}
+
+	buf = append(buf, streamMagic...)
+	buf = appendUint64(buf, uint64(m.count))
+	for i := range m.entries {
+		e := &m.entries[i]
+		if !e.used {
+			continue
+		}
+		if len(buf)+streamPairSize > cap(buf) {
+			if err := flush(); err != nil {
+				return written, err
+			}
+		}
+		buf = appendUint64(appendUint64(buf, e.key), e.value)
+	}
+	return written, flush()
+}
+
+// ReadFrom reads entries in the stream format from r and inserts them into
+// the map, replacing the values of existing keys, returning the number of
+// bytes read. It reads exactly the bytes of one stream, so r may hold further
+// data after it. A stream which ends early returns an error wrapping
+// io.ErrUnexpectedEOF, leaving the entries decoded before the truncation in
+// the map.
+func (m *robinHoodMapU64) ReadFrom(r io.Reader) (int64, error) {
+	var read int64
+	buf := make([]byte, streamBatch*streamPairSize)
+	n, err := io.ReadFull(r, buf[:streamHeaderSize])
+	read += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return read, fmt.Errorf("robinHoodMap: reading stream header: %w", err)
+	}
+	if string(buf[:len(streamMagic)]) != streamMagic {
+		return read, fmt.Errorf("robinHoodMap: invalid stream header %q", buf[:len(streamMagic)])
+	}
+	count := binary.LittleEndian.Uint64(buf[len(streamMagic):streamHeaderSize])
+
+	for done := uint64(0); done < count; {
+		batch := count - done
+		if batch > streamBatch {
+			batch = streamBatch
+		}
+		n, err := io.ReadFull(r, buf[:batch*streamPairSize])
+		read += int64(n)
+		// Insert the complete pairs read before any error.
+		for i := 0; i+streamPairSize <= n; i += streamPairSize {
+			m.Put(binary.LittleEndian.Uint64(buf[i:]), binary.LittleEndian.Uint64(buf[i+8:]))
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, fmt.Errorf("robinHoodMap: stream truncated after %d of %d entries: %w",
+				done+uint64(n/streamPairSize), count, err)
+		}
+		done += batch
+	}
+	return read, nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
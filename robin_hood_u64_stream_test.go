@@ -0,0 +1,121 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRobinHoodU64Stream(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapU64(0)
+	for i := 0; i < 200000; i++ {
+		m.Put(uint64(rng.Int63()), uint64(rng.Int63()))
+	}
+	// The zero key and value are ordinary entries.
+	m.Put(0, 0)
+
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	var written int64
+	go func() {
+		var err error
+		written, err = m.WriteTo(w)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	c := newRobinHoodMapU64(0)
+	read, err := c.ReadFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(streamHeaderSize + streamPairSize*m.Len()); written != expected || read != expected {
+		t.Fatalf("expected %d bytes, but wrote %d and read %d", expected, written, read)
+	}
+	if c.Len() != m.Len() {
+		t.Fatalf("expected %d entries, but found %d", m.Len(), c.Len())
+	}
+	for i := range m.entries {
+		if e := &m.entries[i]; e.used {
+			if v, ok := c.Get(e.key); !ok || v != e.value {
+				t.Fatalf("%d: expected (%d,true), but found (%d,%t)", e.key, e.value, v, ok)
+			}
+		}
+	}
+}
+
+func TestRobinHoodU64StreamTrailingData(t *testing.T) {
+	m := newRobinHoodMapU64(0)
+	for k := uint64(0); k < 1000; k++ {
+		m.Put(k, k*k)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailer")
+
+	c := newRobinHoodMapU64(0)
+	if _, err := c.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1000 {
+		t.Fatalf("expected 1000 entries, but found %d", c.Len())
+	}
+	if rest := buf.String(); rest != "trailer" {
+		t.Fatalf("expected the trailer to be unread, but found %q", rest)
+	}
+}
+
+func TestRobinHoodU64StreamTruncated(t *testing.T) {
+	m := newRobinHoodMapU64(0)
+	for k := uint64(0); k < 1000; k++ {
+		m.Put(k, k)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, n := range []int{0, 3, streamHeaderSize, streamHeaderSize + 5, streamHeaderSize + 300*streamPairSize, len(data) - 1} {
+		c := newRobinHoodMapU64(0)
+		read, err := c.ReadFrom(bytes.NewReader(data[:n]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%d: expected unexpected EOF, but found %v", n, err)
+		}
+		if read != int64(n) {
+			t.Fatalf("%d: expected %d bytes read, but found %d", n, n, read)
+		}
+		// The complete entries before the truncation are kept.
+		if expected := (n - streamHeaderSize) / streamPairSize; n >= streamHeaderSize && c.Len() != expected {
+			t.Fatalf("%d: expected %d entries, but found %d", n, expected, c.Len())
+		}
+	}
+
+	c := newRobinHoodMapU64(0)
+	if _, err := c.ReadFrom(bytes.NewReader([]byte("not a map stream"))); err == nil {
+		t.Fatalf("expected an invalid header error")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRobinHoodU64(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	m := newRobinHoodMapU64(0)
+	values := make(map[uint64]uint64)
+	for i := 0; i < 1000; i++ {
+		k := uint64(rng.Intn(1 << 20))
+		// Store plenty of zero values.
+		v := uint64(rng.Intn(4))
+		values[k] = v
+		m.Put(k, v)
+	}
+	if m.Len() != len(values) {
+		t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+	}
+	for k, v := range values {
+		if p, ok := m.Get(k); !ok || p != v {
+			t.Fatalf("%d: expected (%d,true), but found (%d,%t)", k, v, p, ok)
+		}
+	}
+
+	for k, v := range values {
+		if v == 0 {
+			m.Delete(k)
+			delete(values, k)
+			if _, ok := m.Get(k); ok {
+				t.Fatalf("%d: expected deleted", k)
+			}
+		}
+	}
+	if m.Len() != len(values) {
+		t.Fatalf("expected %d entries, but found %d", len(values), m.Len())
+	}
+	for k, v := range values {
+		if p, ok := m.Get(k); !ok || p != v {
+			t.Fatalf("%d: expected (%d,true), but found (%d,%t)", k, v, p, ok)
+		}
+	}
+}
+
+func TestRobinHoodU64ZeroKey(t *testing.T) {
+	m := newRobinHoodMapU64(0)
+	if _, ok := m.Get(0); ok {
+		t.Fatalf("expected missing key")
+	}
+	m.Put(0, 0)
+	if v, ok := m.Get(0); !ok || v != 0 {
+		t.Fatalf("expected (0,true), but found (%d,%t)", v, ok)
+	}
+	m.Delete(0)
+	if _, ok := m.Get(0); ok || m.Len() != 0 {
+		t.Fatalf("expected empty map, but found %d entries", m.Len())
+	}
+}
+
+func BenchmarkRobinHoodBoxedInsert(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, benchSize)
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 20))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var m *robinHoodMap
+	for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+		if m == nil || j == len(keys) {
+			b.StopTimer()
+			m = newRobinHoodMap(len(keys))
+			j = 0
+			b.StartTimer()
+		}
+		v := new(uint64)
+		*v = uint64(i)
+		m.Put(keys[j], unsafe.Pointer(v))
+	}
+}
+
+func BenchmarkRobinHoodU64Insert(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make([]uint64, benchSize)
+	for i := range keys {
+		keys[i] = uint64(rng.Intn(1 << 20))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var m *robinHoodMapU64
+	for i, j := 0, 0; i < b.N; i, j = i+1, j+1 {
+		if m == nil || j == len(keys) {
+			b.StopTimer()
+			m = newRobinHoodMapU64(len(keys))
+			j = 0
+			b.StartTimer()
+		}
+		m.Put(keys[j], uint64(i))
+	}
+}
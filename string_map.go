@@ -0,0 +1,98 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import "unsafe"
+
+// stringMapEntry holds a string key and its value. Keys whose hashes collide
+// are chained through next.
+type stringMapEntry struct {
+	key   string
+	value unsafe.Pointer
+	next  *stringMapEntry
+}
+
+// StringMap is a hash map from string keys to unsafe.Pointer values. It is a
+// thin wrapper around robinHoodMap keyed by the 64-bit hash of each string.
+// The value stored for a hash is a chain of the entries whose keys have that
+// hash, so distinct keys with colliding hashes are told apart by comparing
+// the keys themselves. The underlying map is keyed by the hashes, so the
+// strings are never hashed again when the table grows.
+type StringMap struct {
+	m     *robinHoodMap
+	count int
+	// hash is the string hash function. It is only replaced by tests, to force
+	// collisions.
+	hash func(string) uint64
+}
+
+// NewStringMap returns an empty map sized to hold initialCapacity entries
+// without growing, unless their hashes collide.
+func NewStringMap(initialCapacity int) *StringMap {
+	return &StringMap{m: newRobinHoodMap(initialCapacity), hash: stringHash}
+}
+
+// Get returns the value for the specified key, or nil if the key is not
+// present.
+func (m *StringMap) Get(k string) unsafe.Pointer {
+	for e := (*stringMapEntry)(m.m.Get(m.hash(k))); e != nil; e = e.next {
+		if e.key == k {
+			return e.value
+		}
+	}
+	return nil
+}
+
+// Put inserts the entry for the specified key, replacing the value of an
+// existing entry. The value must not be nil.
+func (m *StringMap) Put(k string, v unsafe.Pointer) {
+	if v == nil {
+		panic("robinHoodMap: nil value")
+	}
+	h := m.hash(k)
+	head := (*stringMapEntry)(m.m.Get(h))
+	for e := head; e != nil; e = e.next {
+		if e.key == k {
+			e.value = v
+			return
+		}
+	}
+	m.m.Put(h, unsafe.Pointer(&stringMapEntry{key: k, value: v, next: head}))
+	m.count++
+}
+
+// Delete removes the entry for the specified key, if present.
+func (m *StringMap) Delete(k string) {
+	h := m.hash(k)
+	head := (*stringMapEntry)(m.m.Get(h))
+	for p := &head; *p != nil; p = &(*p).next {
+		if (*p).key == k {
+			*p = (*p).next
+			if head == nil {
+				m.m.Delete(h)
+			} else if p == &head {
+				m.m.Put(h, unsafe.Pointer(head))
+			}
+			m.count--
+			return
+		}
+	}
+}
+
+// Len returns the number of entries in the map.
+func (m *StringMap) Len() int {
+	return m.count
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Peter Mattis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package maptoy
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestStringMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	hashes := []struct {
+		name string
+		hash func(string) uint64
+	}{
+		{"fnv", stringHash},
+		// Hashing by length makes most keys collide, and the key sets below
+		// include the empty string and keys which collide with it.
+		{"length", func(s string) uint64 { return uint64(len(s)) }},
+		{"constant", func(string) uint64 { return 7 }},
+	}
+	for _, c := range hashes {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewStringMap(0)
+			m.hash = c.hash
+			ref := make(map[string]unsafe.Pointer)
+			for i := 0; i < 5000; i++ {
+				k := fmt.Sprint(rng.Intn(500))
+				if i%10 == 0 {
+					k = ""
+				}
+				if rng.Intn(3) == 0 {
+					m.Delete(k)
+					delete(ref, k)
+					continue
+				}
+				ref[k] = unsafe.Pointer(new(int))
+				m.Put(k, ref[k])
+			}
+
+			if m.Len() != len(ref) {
+				t.Fatalf("expected %d entries, but found %d", len(ref), m.Len())
+			}
+			for k, v := range ref {
+				if p := m.Get(k); p != v {
+					t.Fatalf("%q: expected %p, but found %p", k, v, p)
+				}
+			}
+			// Absent keys with the same hashes as present ones are not found.
+			for i := 500; i < 1000; i++ {
+				if k := fmt.Sprint(i); m.Get(k) != nil {
+					t.Fatalf("%q: expected nil, but found %p", k, m.Get(k))
+				}
+			}
+
+			for k := range ref {
+				m.Delete(k)
+				if p := m.Get(k); p != nil {
+					t.Fatalf("%q: expected deleted, but found %p", k, p)
+				}
+			}
+			if m.Len() != 0 || m.m.Len() != 0 {
+				t.Fatalf("expected empty map, but found %d entries and %d hashes", m.Len(), m.m.Len())
+			}
+		})
+	}
+}